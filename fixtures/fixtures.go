@@ -0,0 +1,165 @@
+/*
+fixtures records and serves the http fixtures in ica/testdata,
+opac/testdata and otraf/testdata. Run it from the repository root.
+
+	fixtures record --site=opac --user=12345678 --password=0000
+	fixtures serve --site=opac --address=:8081
+
+record runs the real login and scrape with a recording transport and
+saves sanitized responses. The parser tests replay them, go test ./opac
+-update rewrites the expected json. The fixtures in the repository are
+synthetic, hand written in the recorded format with made up data, so
+record them against the real sites before trusting a parser change.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andersbetner/homeautomation/ica"
+	"github.com/andersbetner/homeautomation/opac"
+	"github.com/andersbetner/homeautomation/otraf"
+	"github.com/andersbetner/homeautomation/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// record runs the real flow for site and saves the responses
+func record(site string, user string, password string, tab string) error {
+	ctx := context.Background()
+	dir := path.Join(site, "testdata")
+	recorder := util.WithTransport(&util.RecordingTransport{
+		Dir:     dir,
+		Secrets: []string{user, password},
+	})
+	switch site {
+	case "ica":
+		c, err := ica.NewClient(recorder)
+		if err != nil {
+			return err
+		}
+		resp, err := c.GetHTML(ctx, user, password)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		err = c.Login(ctx, user, password)
+		if err != nil {
+			return err
+		}
+		resp, err = c.GetAccount(ctx)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		resp, err = c.GetTransactions(ctx)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		resp, err = c.GetBonus(ctx)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		resp, err = c.GetStores(ctx)
+		if err != nil {
+			return err
+		}
+		stores, err := ica.ParseStores(resp)
+		if err != nil {
+			return err
+		}
+		resp, err = c.GetOffers(ctx, stores)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	case "opac":
+		c, err := opac.NewClient(user, password, recorder)
+		if err != nil {
+			return err
+		}
+		err = c.Login(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = opac.Parse(ctx, c, opac.New(user))
+		if err != nil {
+			return err
+		}
+	case "otraf":
+		c, err := otraf.NewClient(recorder)
+		if err != nil {
+			return err
+		}
+		cards, err := c.Cards(ctx, user, password)
+		if err != nil {
+			return err
+		}
+		if len(cards) > 0 && cards[0].Number != "" {
+			_, err = c.Transactions(ctx, cards[0].Number, time.Time{})
+			if err != nil {
+				return err
+			}
+		}
+		resp, err := c.GetHTML(ctx, user, password, tab)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	default:
+		return fmt.Errorf("Unknown site %s", site)
+	}
+	log.WithField("dir", dir).Info("Fixtures recorded, check them for personal data before committing")
+
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		os.Stderr.WriteString("usage: fixtures record|serve [flags]\n")
+		os.Exit(1)
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	site := flags.String("site", "", "ica, opac or otraf")
+	user := flags.String("user", "", "user to record with")
+	password := flags.String("password", "", "password to record with")
+	tab := flags.String("tab", "", "otraf card tab to record")
+	address := flags.String("address", ":8081", "address for serve eg :8081")
+	flags.Parse(os.Args[2:])
+
+	switch command {
+	case "record":
+		if *site == "" || *user == "" || *password == "" {
+			os.Stderr.WriteString("--site, --user and --password are required\n")
+			os.Exit(1)
+		}
+		err := record(*site, *user, *password, *tab)
+		if err != nil {
+			log.WithField("error", err).Error("Error recording")
+			os.Exit(1)
+		}
+	case "serve":
+		if *site == "" {
+			os.Stderr.WriteString("--site missing eg --site=opac\n")
+			os.Exit(1)
+		}
+		srv, err := util.NewFixtureServer(path.Join(*site, "testdata"))
+		if err != nil {
+			log.WithField("error", err).Error("Error loading fixtures")
+			os.Exit(1)
+		}
+		log.WithField("address", *address).Info("Serving ", *site, " fixtures")
+		log.Fatal(http.ListenAndServe(*address, srv))
+	default:
+		os.Stderr.WriteString("usage: fixtures record|serve [flags]\n")
+		os.Exit(1)
+	}
+}
@@ -6,15 +6,13 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -23,7 +21,7 @@ import (
 // env public path MQTTHOST
 
 var (
-	mqttHost      string
+	daemon        = util.NewDaemon("sitebuilder")
 	publicPath    string
 	templates     = make(map[string]*template.Template)
 	page          = newPageData()
@@ -37,22 +35,24 @@ var (
 )
 
 type pageData struct {
-	Ica         int64
+	Icas        map[string]*util.Ica // By account
 	Temperature util.Temperature
 	Users       []string
 	Opacs       map[string]*util.Opac
+	OpacStats   map[string]*util.OpacStats
 	Otrafs      map[string]*util.Otraf
 }
 
 func newPageData() *pageData {
 	p := &pageData{}
-	p.Ica = -99
+	p.Icas = make(map[string]*util.Ica)
 	p.Temperature = *util.NewTemperature()
 	p.Users = []string{"anders", "anna", "lowe", "malva", "vega"}
 	p.Opacs = make(map[string]*util.Opac)
 	for _, user := range p.Users {
 		p.Opacs[user] = new(util.Opac)
 	}
+	p.OpacStats = make(map[string]*util.OpacStats)
 	p.Otrafs = make(map[string]*util.Otraf)
 	for _, user := range p.Users {
 		p.Otrafs[user] = new(util.Otraf)
@@ -73,6 +73,32 @@ func libraryName(name string) string {
 	return ""
 }
 
+// mediaType returns the swedish name for an opac media type
+func mediaType(name string) string {
+	switch name {
+	case "audiobook":
+		return "ljudbok"
+	case "ebook":
+		return "e-bok"
+	case "dvd":
+		return "DVD"
+	}
+	return name
+}
+
+// debtReason returns the swedish name for an opac debt reason
+func debtReason(reason string) string {
+	switch reason {
+	case "late_fee":
+		return "förseningsavgift"
+	case "lost_item":
+		return "förkommen"
+	case "reservation_fee":
+		return "reservationsavgift"
+	}
+	return "avgift"
+}
+
 func (p *pageData) OpacsSlice() []*util.Opac {
 	var ret []*util.Opac
 	for _, user := range p.Users {
@@ -82,6 +108,24 @@ func (p *pageData) OpacsSlice() []*util.Opac {
 	return ret
 }
 
+// OpacStatsFor returns the reading stats for name, nil if there are none
+func (p *pageData) OpacStatsFor(name string) *util.OpacStats {
+	return p.OpacStats[strings.ToLower(name)]
+}
+
+// IcasSlice returns the ica accounts sorted by name
+func (p *pageData) IcasSlice() []*util.Ica {
+	var ret []*util.Ica
+	for _, ica := range p.Icas {
+		ret = append(ret, ica)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
 func (p *pageData) OtrafsSlice() []*util.Otraf {
 	var ret []*util.Otraf
 	for _, user := range p.Users {
@@ -172,33 +216,42 @@ func updateTemperature(client mqtt.Client, msg mqtt.Message) {
 }
 
 func updateIca(client mqtt.Client, msg mqtt.Message) {
-	value, err := strconv.ParseInt(string(msg.Payload()), 10, 64)
+	account := path.Base(path.Dir(msg.Topic()))
+	ica := new(util.Ica)
+	err := json.Unmarshal(msg.Payload(), &ica)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"type":  "ica",
-			"name":  "amount",
-			"value": msg.Payload()}).Error("Error converting int value")
-		updateCounter.WithLabelValues("500", "ica", "amount").Inc()
+			"name":  account,
+			"value": string(msg.Payload())}).Error("Error unmarshal json")
+		updateCounter.WithLabelValues("500", "ica", account).Inc()
 
 		return
 	}
-	page.Ica = value
-	render("index.html")
+	if ica.Name == "" {
+		ica.Name = account
+	}
+	page.Icas[account] = ica
+	err = render("index.html")
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"type":  "ica",
-			"name":  "amount"}).Error("Error rendering ica")
-		updateCounter.WithLabelValues("500", "ica", "amount").Inc()
+			"name":  account}).Error("Error rendering ica")
+		updateCounter.WithLabelValues("500", "ica", account).Inc()
 
 		return
 	}
-	updateCounter.WithLabelValues("200", "ica", "amount").Inc()
+	updateCounter.WithLabelValues("200", "ica", account).Inc()
 }
 
 func updateOpac(client mqtt.Client, msg mqtt.Message) {
 	user := path.Base(msg.Topic())
+	if _, ok := page.Opacs[user]; !ok || msg.Topic() != "opac/"+user {
+		// Commands like opac/update
+		return
+	}
 	opac := new(util.Opac)
 	err := json.Unmarshal(msg.Payload(), &opac)
 	if err != nil {
@@ -227,8 +280,45 @@ func updateOpac(client mqtt.Client, msg mqtt.Message) {
 	updateCounter.WithLabelValues("200", "opac", user).Inc()
 }
 
+func updateOpacStats(client mqtt.Client, msg mqtt.Message) {
+	user := path.Base(path.Dir(msg.Topic()))
+	if _, ok := page.Opacs[user]; !ok {
+		return
+	}
+	stats := new(util.OpacStats)
+	err := json.Unmarshal(msg.Payload(), &stats)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"type":  "opacstats",
+			"name":  user,
+			"value": string(msg.Payload())}).Error("Error unmarshal json")
+		updateCounter.WithLabelValues("500", "opacstats", user).Inc()
+
+		return
+	}
+
+	page.OpacStats[user] = stats
+
+	err = render("library.html")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"type":  "opacstats",
+			"name":  user}).Error("Error rendering opac")
+		updateCounter.WithLabelValues("500", "opacstats", user).Inc()
+
+		return
+	}
+	updateCounter.WithLabelValues("200", "opacstats", user).Inc()
+}
+
 func updateOtraf(client mqtt.Client, msg mqtt.Message) {
 	user := path.Base(msg.Topic())
+	if _, ok := page.Otrafs[user]; !ok || msg.Topic() != "otraf/"+user {
+		// Commands like otraf/update
+		return
+	}
 	otraf := new(util.Otraf)
 	err := json.Unmarshal(msg.Payload(), &otraf)
 	if err != nil {
@@ -260,14 +350,8 @@ func updateOtraf(client mqtt.Client, msg mqtt.Message) {
 func init() {
 	prometheus.MustRegister(updateCounter)
 
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
 	flag.StringVar(&publicPath, "publicpath", "", "path where site is rendered eg /www/site")
-	flag.Parse()
-	var exit bool
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
-	}
+	exit := daemon.ParseFlags()
 
 	if publicPath == "" {
 		os.Stderr.WriteString("--publicpath missing eg --publicpath=/www/site\n")
@@ -280,6 +364,8 @@ func init() {
 	funcMap := template.FuncMap{
 		"ToLower":     strings.ToLower,
 		"libraryName": libraryName,
+		"mediaType":   mediaType,
+		"debtReason":  debtReason,
 	}
 	templates["index.html"] = template.Must(template.ParseFiles("templates/index.html", "templates/layout.html"))
 	templates["library.html"] = template.Must(template.New("").Funcs(funcMap).ParseFiles("templates/library.html", "templates/layout.html"))
@@ -295,31 +381,16 @@ func init() {
 func main() {
 
 	render("index.html")
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("prometheus", ":9100", prometheusMux)
-	host, err := os.Hostname()
-	if err != nil {
-		host = "sune"
-	}
-	agent := ag.NewAgent(mqttHost, "sitebuilder-"+host)
-	err = agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
-	}
-	agent.Subscribe("temperature/outdoor/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_loft_temperature/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_hall_uppe_temperature/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_hall_nere_temperature/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_sovrum_temperature/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_badrum_uppe_temperature/state", updateTemperature)
-	agent.Subscribe("homeassistant/sensor/motion_tvattstuga_temperature/state", updateTemperature)
-	agent.Subscribe("ica/availableamount", updateIca)
-	agent.Subscribe("opac/#", updateOpac)
-	agent.Subscribe("otraf/#", updateOtraf)
-
-	for !agent.IsTerminated() {
-		time.Sleep(time.Second * 2)
-	}
+	daemon.Subscribe("temperature/outdoor/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_loft_temperature/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_hall_uppe_temperature/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_hall_nere_temperature/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_sovrum_temperature/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_badrum_uppe_temperature/state", updateTemperature)
+	daemon.Subscribe("homeassistant/sensor/motion_tvattstuga_temperature/state", updateTemperature)
+	daemon.Subscribe("ica/+/all", updateIca)
+	daemon.Subscribe("opac/#", updateOpac)
+	daemon.Subscribe("opac/+/stats", updateOpacStats)
+	daemon.Subscribe("otraf/#", updateOtraf)
+	daemon.Run()
 }
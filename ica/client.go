@@ -2,44 +2,62 @@ package ica
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
 	"golang.org/x/net/publicsuffix"
 )
 
 // Client connects to ICA via the app api
 type Client struct {
 	AuthenticationTicket string
-	Client               http.Client
+	client               *http.Client
+	apiURL               string
+	webURL               string
+	loginURL             string
+}
+
+// NewClient creates a new Client
+func NewClient(opts ...util.ClientOption) (*Client, error) {
+	o := util.NewClientOptions(opts...)
+	c := &Client{}
+	c.apiURL = o.URL("https://handla.api.ica.se")
+	c.webURL = o.URL("https://www.ica.se")
+	c.loginURL = o.URL("https://ims.icagruppen.se")
+	var err error
+	c.client, err = o.NewHTTPClient()
+
+	return c, err
 }
 
 // Login performs a login for the json api
-func (c *Client) Login(user string, password string) (err error) {
-	client := &http.Client{
-		CheckRedirect: nil,
-		Timeout:       time.Second * 10,
-	}
-	request, _ := http.NewRequest("GET", "https://handla.api.ica.se/api/login/", nil)
+func (c *Client) Login(ctx context.Context, user string, password string) (err error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", c.apiURL+"/api/login/", nil)
 	request.SetBasicAuth(user, password)
-	resp, err := client.Do(request)
+	resp, err := util.CheckResponse(c.client.Do(request))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	c.AuthenticationTicket = resp.Header.Get("AuthenticationTicket")
+	if c.AuthenticationTicket == "" {
+		return util.Errorf(util.ErrAuthFailed, "No AuthenticationTicket in login response")
+	}
 
 	return nil
 }
 
-func (c *Client) request(url string) (resp *http.Response, err error) {
-	request, _ := http.NewRequest("GET", url, nil)
+func (c *Client) request(ctx context.Context, url string) (resp *http.Response, err error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	request.Header.Add("AuthenticationTicket", c.AuthenticationTicket)
-	resp, err = c.Client.Do(request)
+	resp, err = util.CheckResponse(c.client.Do(request))
 	if err != nil {
 		return resp, err
 	}
@@ -48,45 +66,73 @@ func (c *Client) request(url string) (resp *http.Response, err error) {
 }
 
 // GetAccount returns accounts
-func (c *Client) GetAccount() (resp *http.Response, err error) {
+func (c *Client) GetAccount(ctx context.Context) (resp *http.Response, err error) {
 
-	return c.request("https://handla.api.ica.se/api/user/cardaccounts")
+	return c.request(ctx, c.apiURL+"/api/user/cardaccounts")
 }
 
 // GetTransactions returns all transactions
-func (c *Client) GetTransactions() (resp *http.Response, err error) {
+func (c *Client) GetTransactions(ctx context.Context) (resp *http.Response, err error) {
+
+	return c.request(ctx, c.apiURL+"/api/user/minbonustransaction")
+}
+
+// GetBonus returns the bonus level and the bonus acquired this year
+func (c *Client) GetBonus(ctx context.Context) (resp *http.Response, err error) {
+
+	return c.request(ctx, c.apiURL+"/api/user/minbonus")
+}
 
-	return c.request("https://handla.api.ica.se/api/user/minbonustransaction")
+// GetStores returns the favorite stores
+func (c *Client) GetStores(ctx context.Context) (resp *http.Response, err error) {
+
+	return c.request(ctx, c.apiURL+"/api/user/stores")
+}
+
+// GetOffers returns the personal offers in stores, see ParseStores
+func (c *Client) GetOffers(ctx context.Context, stores []int) (resp *http.Response, err error) {
+	ids := make([]string, len(stores))
+	for i, id := range stores {
+		ids[i] = strconv.Itoa(id)
+	}
+
+	return c.request(ctx, c.apiURL+"/api/user/offers?Stores="+strings.Join(ids, ","))
 }
 
 // GetHTML fetches the page for a user and returns a http.Response
-func (c *Client) GetHTML(user string, password string) (resp *http.Response, err error) {
+func (c *Client) GetHTML(ctx context.Context, user string, password string) (resp *http.Response, err error) {
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		return resp, err
 	}
 
-	client := &http.Client{
-		Jar: jar,
+	// Every login starts a new session
+	client := *c.client
+	client.Jar = jar
+	get := func(url string) (*http.Response, error) {
+		r, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		return util.CheckResponse(client.Do(r))
 	}
 	// The page we want
-	resp, err = client.Get("https://www.ica.se/templates/ajaxresponse.aspx?ajaxFunction=DashboardAccountInfo&callerPageId=446575&_=1511639168567")
+	resp, err = get(c.webURL + "/templates/ajaxresponse.aspx?ajaxFunction=DashboardAccountInfo&callerPageId=446575&_=1511639168567")
 	if err != nil {
 		return resp, err
 	}
-	resp, err = client.Get("https://www.ica.se/logga-in/sso/?returnurl=https://www.ica.se/templates/ajaxresponse.aspx?ajaxFunction=DashboardAccountInfo&callerPageId=446575&_=1511639168567")
+	resp.Body.Close()
+	resp, err = get(c.webURL + "/logga-in/sso/?returnurl=" + c.webURL + "/templates/ajaxresponse.aspx?ajaxFunction=DashboardAccountInfo&callerPageId=446575&_=1511639168567")
 	if err != nil {
 		return resp, err
 	}
 	referer := resp.Request.URL.String()
+	resp.Body.Close()
 	post := url.Values{}
 	post.Add("userName", user)
 	post.Add("password", password)
 
-	r, _ := http.NewRequest("POST", "https://ims.icagruppen.se/authn/authenticate/IcaCustomers", bytes.NewBufferString(post.Encode()))
+	r, _ := http.NewRequestWithContext(ctx, "POST", c.loginURL+"/authn/authenticate/IcaCustomers", bytes.NewBufferString(post.Encode()))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Set("Referer", referer)
-	r.Header.Set("Origin", "https://ims.icagruppen.se")
+	r.Header.Set("Origin", c.loginURL)
 	r.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
 	r.Header.Set("Upgrade-Insecure-Requests", "1")
 	r.Header.Set("Sec-Fetch-Dest", "document")
@@ -96,14 +142,18 @@ func (c *Client) GetHTML(user string, password string) (resp *http.Response, err
 	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
 	r.Header.Set("Accept-Language", "en,sv;q=0.9,no;q=0.8,nn;q=0.7,nb;q=0.6,en-US;q=0.5,pl;q=0.4")
 
-	resp, err = client.Do(r)
+	resp, err = util.CheckResponse(client.Do(r))
 	if err != nil {
 		return resp, err
 	}
 	// Extra form with tokens to post
 	doc, err := goquery.NewDocumentFromResponse(resp)
 	if err != nil {
-		return resp, err
+		return resp, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	if doc.Find("input[type=\"password\"]").Length() > 0 {
+		// Back at the login form
+		return resp, util.Errorf(util.ErrAuthFailed, "Login form returned after authenticate")
 	}
 	post = url.Values{}
 	doc.Find("input[type=\"hidden\"]").Each(func(i int, s *goquery.Selection) {
@@ -111,7 +161,12 @@ func (c *Client) GetHTML(user string, password string) (resp *http.Response, err
 		value, _ := s.Attr("value")
 		post.Add(name, value)
 	})
-	resp, err = client.PostForm("https://ims.icagruppen.se/oauth/v2/authorize?client_id=ica.se&forceAuthN=true", post)
+	if len(post) == 0 {
+		return resp, util.Errorf(util.ErrLayoutChanged, "No token form after authenticate")
+	}
+	r, _ = http.NewRequestWithContext(ctx, "POST", c.loginURL+"/oauth/v2/authorize?client_id=ica.se&forceAuthN=true", strings.NewReader(post.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = util.CheckResponse(client.Do(r))
 	if err != nil {
 		return resp, err
 	}
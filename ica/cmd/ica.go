@@ -1,176 +1,419 @@
 /*
 mqtt topics
-ica/update (Will update on whatever message)
-ica/availableamount
-ica/all
+ica/update (Will update all accounts, or the account named in the message)
+ica/<name>/availableamount
+ica/<name>/all
+ica/<name>/bonus (Bonus level and discount per month and store, see util.IcaBonus)
+ica/<name>/offers (Personal offers in the favorite stores)
+ica/<name>/transaction (A new transaction in the ledger, see --ledgerdir)
+ica/<name>/status (Result of the last update, see util.JobStatus)
 
-type, topic, status
+type, topic, status, account
+
+Without --config a single account named ica is read from env ICA_USER and
+ICA_PASSWORD, as before users.json. The env is also the fallback for the
+credentials when users.json has one account.
+
+--exportaddress serves the ledger at /<name>.csv, /<name>.ledger and
+/<name>.beancount
 */
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"net/http"
 	"os"
-	"os/signal"
+	"path"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/andersbetner/homeautomation/ica"
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+// user is an ICA account in users.json, the password can be left out
+// and read with --secretdir, --credentials or env ICA_<NAME>_PASSWORD
+type user struct {
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Account and Expense are the accounts in the ledger exports,
+	// Liabilities:ICA:<Name> and Expenses:Groceries if empty
+	Account string `json:"account"`
+	Expense string `json:"expense"`
+}
+
 var (
-	mqttHost          string
-	icaUser           string
-	icaPassword       string
-	agent             *ag.Agent
-	updateInterval    int // Minutes default = 30
+	daemon            = util.NewDaemon("ica")
+	users             []user
+	clientFlags       util.ClientFlags
+	credentialFlags   util.CredentialFlags
+	ledgerDir         string
+	exportAddress     string
+	ledgers           = make(map[string]*ica.Ledger) // By account
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_sensor_updates_total",
 			Help: "How many times this item has been updated.",
 		},
-		[]string{"status", "type", "topic"},
+		[]string{"status", "type", "topic", "account"},
 	)
 	promAmount = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "ab_ica",
 			Help: "ICA data",
-		}, []string{"topic"},
+		}, []string{"topic", "account"},
+	)
+	promBonusLevel = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_ica_bonus_level",
+			Help: "ICA bonus level",
+		}, []string{"account"},
+	)
+	promBonus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_ica_bonus",
+			Help: "ICA bonus acquired this year in SEK",
+		}, []string{"account"},
+	)
+	promDiscount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_ica_discount",
+			Help: "ICA discount this year or month in SEK",
+		}, []string{"period", "account"},
 	)
 )
 
-// update gets the latest account funds from ica.se
-func update() {
-	icaClient := &ica.Client{}
-	icaData := ica.New()
+// update returns a job that gets the latest account funds for u from
+// ica.se
+func update(u user) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		account := strings.ToLower(u.Name)
+		icaData := ica.New(u.Name)
+		icaClient, err := ica.NewClient(clientFlags.Options()...)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": account,
+				"topic":   "client"}).Error("Error creating client")
 
-	resp, err := icaClient.GetHTML(icaUser, icaPassword)
-	if err != nil {
-		promUpdateCounter.WithLabelValues("500", "ica", "gethtml").Inc()
-		log.WithFields(log.Fields{"error": err,
-			"type":  "ica",
-			"topic": "gethtml"}).Error("Error getting html")
+			return err
+		}
 
-		return
-	}
+		icaData, err = icaClient.Fetch(ctx, u.User, u.Password, icaData)
+		if err != nil {
+			if errors.Is(err, util.ErrLayoutChanged) {
+				promUpdateCounter.WithLabelValues("500", "ica", "parse", account).Inc()
+			} else {
+				promUpdateCounter.WithLabelValues("500", "ica", "gethtml", account).Inc()
+			}
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"kind":    util.ErrorKind(err),
+				"account": account,
+				"topic":   "fetch"}).Error("Error getting account")
 
-	icaData, err = ica.ParseHTML(resp, icaData)
-	resp, err = icaClient.GetAccount()
-	if err != nil {
-		promUpdateCounter.WithLabelValues("500", "ica", "parse").Inc()
-		log.WithFields(log.Fields{"error": err,
-			"type":  "ica",
-			"topic": "parse"}).Error("Error parsing account data")
+			return err
+		}
+		if icaData.Source == ica.API {
+			updateBonus(ctx, icaClient, account, icaData)
+			updateLedger(account, icaData)
+		}
 
-		return
+		err = daemon.Publish("ica/"+account+"/availableamount", true, strconv.Itoa(int(icaData.Available)))
+		if err != nil {
+			promUpdateCounter.WithLabelValues("500", "ica", "publish", account).Inc()
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": account,
+				"topic":   "availableamount"}).Error("Error publishing availableamount")
+
+			return err
+		}
+		promUpdateCounter.WithLabelValues("200", "ica", "availableamount", account).Inc()
+		promAmount.WithLabelValues("availableamount", account).Set(icaData.Available)
 
+		b, err := json.Marshal(icaData)
+		if err != nil {
+			promUpdateCounter.WithLabelValues("500", "ica", "json", account).Inc()
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": account,
+				"topic":   "json"}).Error("Error marshalling json")
+
+			return err
+		}
+		err = daemon.Publish("ica/"+account+"/all", true, string(b))
+		if err != nil {
+			promUpdateCounter.WithLabelValues("500", "ica", "publish", account).Inc()
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": account,
+				"topic":   "all"}).Error("Error publishing all")
+
+			return err
+		}
+		promUpdateCounter.WithLabelValues("200", "ica", "all", account).Inc()
+		log.WithFields(log.Fields{"amount": icaData.Available,
+			"account": account}).Debug("Update published")
+
+		return nil
 	}
+}
 
-	err = agent.Publish("ica/availableamount", true, strconv.Itoa(int(icaData.Available)))
+// getBonus adds the bonus and the offers to icaData. The client must be
+// logged in to the api, eg by fetching from ica.API.
+func getBonus(ctx context.Context, c *ica.Client, icaData *ica.Ica) error {
+	resp, err := c.GetBonus(ctx)
 	if err != nil {
-		promUpdateCounter.WithLabelValues("500", "ica", "publish").Inc()
-		log.WithFields(log.Fields{"error": err,
-			"type":  "ica",
-			"topic": "availableamount"}).Error("Error publishing ica/availableamount")
-
-		return
+		return err
 	}
-	promUpdateCounter.WithLabelValues("200", "ica", "availableamount").Inc()
-	promAmount.WithLabelValues("availableamount").Set(icaData.Available)
+	if _, err = ica.ParseBonus(resp, icaData); err != nil {
+		return err
+	}
+	resp, err = c.GetStores(ctx)
+	if err != nil {
+		return err
+	}
+	stores, err := ica.ParseStores(resp)
+	if err != nil || len(stores) == 0 {
+		return err
+	}
+	resp, err = c.GetOffers(ctx, stores)
+	if err != nil {
+		return err
+	}
+	_, err = ica.ParseOffers(resp, icaData)
 
-	b, err := json.Marshal(icaData)
+	return err
+}
+
+// updateBonus publishes the bonus, discounts and offers. Failing is
+// logged, the funds are published anyway. The discounts are in the api
+// transactions, not in the html.
+func updateBonus(ctx context.Context, c *ica.Client, topic string, icaData *ica.Ica) {
+	err := getBonus(ctx, c, icaData)
 	if err != nil {
-		promUpdateCounter.WithLabelValues("500", "ica", "json").Inc()
 		log.WithFields(log.Fields{"error": err,
-			"type":  "ica",
-			"topic": "json"}).Error("Error marshalling json")
+			"type":    "ica",
+			"kind":    util.ErrorKind(err),
+			"account": topic,
+			"topic":   "bonus"}).Error("Error getting bonus")
+		return
+	}
+	now := time.Now()
+	bonus := util.IcaBonus{}
+	bonus.Name = icaData.Name
+	bonus.Year = now.Year()
+	bonus.Level = icaData.Bonus.Level
+	bonus.Percentage = icaData.Bonus.Percentage
+	bonus.Acquired = icaData.Bonus.Acquired
+	bonus.AmountToNextLevel = icaData.Bonus.AmountToNextLevel
+	bonus.Months = icaData.DiscountPerMonth(bonus.Year)
+	for _, d := range bonus.Months {
+		bonus.Discount += d
+	}
+	bonus.Stores = icaData.DiscountPerStore(bonus.Year)
+	bonus.Updated = now
+	promBonusLevel.WithLabelValues(topic).Set(float64(bonus.Level))
+	promBonus.WithLabelValues(topic).Set(bonus.Acquired)
+	promDiscount.WithLabelValues("year", topic).Set(bonus.Discount)
+	promDiscount.WithLabelValues("month", topic).Set(bonus.Months[now.Month()-1])
+	for name, v := range map[string]interface{}{"bonus": bonus, "offers": icaData.Offers} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": topic,
+				"topic":   name}).Error("Error marshalling json")
+			continue
+		}
+		err = daemon.Publish("ica/"+topic+"/"+name, true, string(b))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": topic,
+				"topic":   name}).Error("Error publishing " + name)
+		}
+	}
+}
 
+// updateLedger adds the new transactions to the ledger and publishes
+// them. The first run fills the ledger without publishing the history.
+// The api transactions are used, the html has other signs.
+func updateLedger(topic string, icaData *ica.Ica) {
+	l, ok := ledgers[topic]
+	if !ok {
 		return
 	}
-	err = agent.Publish("ica/all", true, string(b))
+	first := l.Len() == 0
+	added, err := l.Add(icaData.Transactions)
 	if err != nil {
-		promUpdateCounter.WithLabelValues("500", "ica", "publish").Inc()
 		log.WithFields(log.Fields{"error": err,
-			"type":  "ica",
-			"topic": "all"}).Error("Error publishing ica/all")
-
+			"type":    "ica",
+			"account": topic,
+			"topic":   "ledger"}).Error("Error update ledger")
 		return
 	}
-	promUpdateCounter.WithLabelValues("200", "ica", "all").Inc()
-	log.WithField("amount", icaData.Available).Debug("Update published")
+	if first {
+		log.WithFields(log.Fields{"transactions": len(added),
+			"account": topic}).Info("Ledger started")
+		return
+	}
+	for _, t := range added {
+		b, err := json.Marshal(t)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": topic,
+				"topic":   "transaction"}).Error("Error marshalling json")
+			continue
+		}
+		err = daemon.Publish("ica/"+topic+"/transaction", false, string(b))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":    "ica",
+				"account": topic,
+				"topic":   "transaction"}).Error("Error publishing transaction")
+		}
+	}
+}
+
+// capitalize returns s with the first letter upper case
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
 
+	return string(unicode.ToUpper(r)) + s[size:]
 }
 
-// updateHandler acts on mqtt messages to ica/update
-func updateHandler(client mqtt.Client, msg mqtt.Message) {
-	command := string(msg.Payload())
-	log.WithFields(log.Fields{"command": command}).Debug("Update requested through mqtt")
-	update()
+// legacyCredentials returns the credentials in env ICA_USER and
+// ICA_PASSWORD, used for a single account before users.json, false if
+// unset. The user in c is kept if ICA_USER is empty.
+func legacyCredentials(c util.Credentials) (util.Credentials, bool) {
+	password, ok := os.LookupEnv("ICA_PASSWORD")
+	if !ok {
+		return c, false
+	}
+	c.Password = password
+	if user := os.Getenv("ICA_USER"); user != "" {
+		c.User = user
+	}
+
+	return c, true
+}
+
+// exportHandler serves the ledger of an account as csv, ledger-cli or
+// beancount, eg /anders.beancount
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	ext := path.Ext(name)
+	topic := strings.TrimSuffix(name, ext)
+	l, ok := ledgers[topic]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var u user
+	for _, candidate := range users {
+		if strings.ToLower(candidate.Name) == topic {
+			u = candidate
+		}
+	}
+	account := u.Account
+	if account == "" {
+		account = "Liabilities:ICA:" + capitalize(topic)
+	}
+	expense := u.Expense
+	if expense == "" {
+		expense = "Expenses:Groceries"
+	}
+	var err error
+	switch ext {
+	case ".csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = l.WriteCSV(w)
+	case ".ledger":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = l.WriteLedger(w, account, expense)
+	case ".beancount":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = l.WriteBeancount(w, account, expense)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":    "ica",
+			"account": topic,
+			"topic":   "export"}).Error("Error exporting ledger")
+	}
 }
 
 func init() {
-	log.SetLevel(log.DebugLevel)
 	prometheus.MustRegister(promUpdateCounter)
 	prometheus.MustRegister(promAmount)
+	prometheus.MustRegister(promBonusLevel)
+	prometheus.MustRegister(promBonus)
+	prometheus.MustRegister(promDiscount)
 
-	exit := false
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
-	flag.IntVar(&updateInterval, "updateinterval", 30, "integer > 0")
-	flag.Parse()
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
-	}
-	icaUser, _ = os.LookupEnv("ICA_USER")
-	if icaUser == "" {
-		os.Stderr.WriteString("env ICA_USER missing\n")
-		exit = true
-	}
-	icaPassword, _ = os.LookupEnv("ICA_PASSWORD")
-	if icaPassword == "" {
-		os.Stderr.WriteString("env ICA_PASSWORD missing\n")
-		exit = true
-	}
-	if exit {
+	daemon.Scheduled = true
+	daemon.ConfigExample = "/etc/users.json"
+	flag.StringVar(&ledgerDir, "ledgerdir", "", "keep every transaction in this dir eg --ledgerdir=/var/lib/ica")
+	flag.StringVar(&exportAddress, "exportaddress", "", "serve the ledgers as csv, ledger-cli and beancount eg --exportaddress=:8082")
+	clientFlags.Register()
+	credentialFlags.Register()
+	_, daemon.ConfigOptional = os.LookupEnv("ICA_PASSWORD")
+	if daemon.ParseFlags() {
 		os.Exit(1)
 	}
-
-}
-
-func main() {
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("prometheus", ":9100", prometheusMux)
-	host, err := os.Hostname()
-	if err != nil {
-		host = "ica"
+	if daemon.ConfigFile == "" {
+		users = []user{{Name: "ica"}}
+	} else {
+		daemon.LoadConfig(&users)
 	}
-	agent = ag.NewAgent(mqttHost, "ica-"+host)
-	err = agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
+	for _, u := range users {
+		topic := strings.ToLower(u.Name)
+		c, err := credentialFlags.Lookup("ica/"+topic, util.Credentials{User: u.User, Password: u.Password})
+		if errors.Is(err, util.ErrNoCredentials) && len(users) == 1 {
+			if legacy, ok := legacyCredentials(c); ok {
+				c, err = legacy, nil
+			}
+		}
+		if err == nil && c.User == "" {
+			err = errors.New("No user")
+		}
+		if err != nil {
+			os.Stderr.WriteString("Credentials for " + u.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		u.User = c.User
+		u.Password = c.Password
+		if ledgerDir != "" {
+			ledgers[topic], err = ica.OpenLedger(path.Join(ledgerDir, topic+"-ledger.jsonl"))
+			if err != nil {
+				os.Stderr.WriteString("Can't load ledger for " + u.Name + ": " + err.Error() + "\n")
+				os.Exit(1)
+			}
+		}
+		daemon.Schedule(&util.Job{Name: topic, Run: update(u)})
 	}
-	agent.Subscribe("ica/update", updateHandler)
-	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
-		log.Info("Shutting down ica")
-		time.Sleep(2 * time.Second)
-		os.Exit(0)
-	}()
+}
 
-	for !agent.IsTerminated() {
-		update()
-		time.Sleep(time.Duration(updateInterval) * time.Minute)
+func main() {
+	daemon.Subscribe("ica/update", daemon.Scheduler.TriggerHandler())
+	if exportAddress != "" {
+		exportMux := http.NewServeMux()
+		exportMux.HandleFunc("/", exportHandler)
+		daemon.Serve("ica export", exportAddress, exportMux)
 	}
-
+	daemon.Run()
 }
@@ -4,9 +4,44 @@ import "time"
 
 // Ica holds data
 type Ica struct {
+	Name         string
+	Source       string // API or HTML, see Fetch
+	Accounts     []Account
 	Balance      float64
 	Available    float64
 	Transactions []Transaction
+	Bonus        Bonus
+	Offers       []Offer
+}
+
+// Account is an account on an ICA card, eg the credit account
+type Account struct {
+	Card      string // Masked card number
+	CardType  string
+	Name      string
+	Type      string
+	Status    string
+	Balance   float64
+	Available float64
+}
+
+// Bonus is the bonus level, from the purchases the last 12 months
+type Bonus struct {
+	Level             int
+	Percentage        float64 // Bonus on purchases at this level
+	Acquired          float64 // SEK this year
+	AmountToNextLevel float64
+}
+
+// Offer is a personal offer or coupon
+type Offer struct {
+	ID         string
+	Store      int
+	Name       string
+	Condition  string // Eg 2 för 35 kr
+	Type       string
+	Used       bool
+	Expiration time.Time
 }
 
 // Transaction for ica account
@@ -17,9 +52,35 @@ type Transaction struct {
 	Amount   float64
 }
 
-// New returns a new Ica
-func New() *Ica {
+// New returns a new Ica for the account of name
+func New(name string) *Ica {
 	ica := &Ica{}
+	ica.Name = name
 
 	return ica
 }
+
+// DiscountPerMonth returns the discount on the transactions per month in
+// year
+func (ica *Ica) DiscountPerMonth(year int) (months [12]float64) {
+	for _, t := range ica.Transactions {
+		if t.Date.Year() == year {
+			months[t.Date.Month()-1] += t.Discount
+		}
+	}
+
+	return months
+}
+
+// DiscountPerStore returns the discount on the transactions in year per
+// store
+func (ica *Ica) DiscountPerStore(year int) map[string]float64 {
+	stores := make(map[string]float64)
+	for _, t := range ica.Transactions {
+		if t.Date.Year() == year && t.Discount != 0 {
+			stores[t.Location] += t.Discount
+		}
+	}
+
+	return stores
+}
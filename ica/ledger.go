@@ -0,0 +1,165 @@
+package ica
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// key identifies a transaction. Two purchases the same day in the same
+// store for the same amount have the same key, see Ledger.Add.
+func (t Transaction) key() string {
+	return t.Date.Format("2006-01-02") + " " + t.Location + " " + strconv.FormatFloat(t.Amount, 'f', 2, 64)
+}
+
+// Ledger is every transaction seen on an account, the app api only has
+// the last months. Transactions are appended to File as json lines.
+type Ledger struct {
+	File         string
+	mu           sync.Mutex
+	transactions []Transaction
+	count        map[string]int // By key
+}
+
+// OpenLedger loads the transactions in file, a missing file gives an
+// empty ledger. A last line cut short by a crash is dropped, see
+// util.ReadJSONLines.
+func OpenLedger(file string) (*Ledger, error) {
+	l := &Ledger{}
+	l.File = file
+	l.count = make(map[string]int)
+	err := util.ReadJSONLines(file, func(line []byte) error {
+		t := Transaction{}
+		if err := json.Unmarshal(line, &t); err != nil {
+			return err
+		}
+		l.transactions = append(l.transactions, t)
+		l.count[t.key()]++
+
+		return nil
+	})
+
+	return l, err
+}
+
+// Len returns the number of transactions in the ledger
+func (l *Ledger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.transactions)
+}
+
+// Add saves and returns the transactions that aren't in the ledger. A key
+// that is in transactions more times than in the ledger is a new purchase.
+func (l *Ledger) Add(transactions []Transaction) ([]Transaction, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var added []Transaction
+	seen := make(map[string]int)
+	for _, t := range transactions {
+		seen[t.key()]++
+		if seen[t.key()] > l.count[t.key()] {
+			added = append(added, t)
+		}
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	f, err := os.OpenFile(l.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for _, t := range added {
+		line, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+		l.count[t.key()]++
+		l.transactions = append(l.transactions, t)
+	}
+
+	return added, f.Close()
+}
+
+// Transactions returns the transactions sorted by date
+func (l *Ledger) Transactions() []Transaction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	transactions := append([]Transaction{}, l.transactions...)
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Date.Before(transactions[j].Date)
+	})
+
+	return transactions
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// WriteCSV writes the ledger as csv with the columns date, location,
+// amount and discount
+func (l *Ledger) WriteCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	err := c.Write([]string{"date", "location", "amount", "discount"})
+	if err != nil {
+		return err
+	}
+	for _, t := range l.Transactions() {
+		record := []string{t.Date.Format("2006-01-02"), t.Location, formatAmount(t.Amount), formatAmount(t.Discount)}
+		if err = c.Write(record); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+
+	return c.Error()
+}
+
+// WriteLedger writes the ledger in ledger-cli format, every purchase from
+// account to expense eg Liabilities:ICA and Expenses:Groceries
+func (l *Ledger) WriteLedger(w io.Writer, account string, expense string) error {
+	for _, t := range l.Transactions() {
+		entry := t.Date.Format("2006/01/02") + " " + t.Location + "\n"
+		if t.Discount != 0 {
+			entry += "    ; discount: " + formatAmount(t.Discount) + " SEK\n"
+		}
+		entry += fmt.Sprintf("    %s  %s SEK\n    %s\n\n", expense, formatAmount(t.Amount), account)
+		if _, err := io.WriteString(w, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteBeancount writes the ledger in beancount format, every purchase
+// from account to expense eg Liabilities:ICA and Expenses:Groceries
+func (l *Ledger) WriteBeancount(w io.Writer, account string, expense string) error {
+	for _, t := range l.Transactions() {
+		payee := strings.ReplaceAll(t.Location, `"`, `'`)
+		entry := t.Date.Format("2006-01-02") + ` * "` + payee + `" ""` + "\n"
+		if t.Discount != 0 {
+			entry += "  discount: " + formatAmount(t.Discount) + " SEK\n"
+		}
+		entry += fmt.Sprintf("  %s  %s SEK\n  %s  %s SEK\n\n", expense, formatAmount(t.Amount), account, formatAmount(-t.Amount))
+		if _, err := io.WriteString(w, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
 )
 
 type autoGeneratedCustomer struct {
@@ -41,6 +42,42 @@ type autoGeneratedTransactions struct {
 	} `json:"TransactionSummaryByMonth"`
 }
 
+type autoGeneratedBonus struct {
+	BonusLevel        int     `json:"BonusLevel"`
+	BonusPercentage   float64 `json:"BonusPercentage"`
+	AcquiredBonus     float64 `json:"AcquiredBonus"`
+	AmountToNextLevel float64 `json:"AmountToNextLevel"`
+}
+type autoGeneratedStores struct {
+	FavoriteStores []int `json:"FavoriteStores"`
+}
+type autoGeneratedOffers struct {
+	Offers []struct {
+		OfferID        string `json:"OfferId"`
+		StoreID        int    `json:"StoreId"`
+		ProductName    string `json:"ProductName"`
+		OfferCondition string `json:"OfferCondition"`
+		OfferType      string `json:"OfferType"`
+		OfferUsed      bool   `json:"OfferUsed"`
+		ExpirationDate string `json:"ExpirationDate"`
+	} `json:"Offers"`
+}
+
+// readJSON reads the json in resp into v
+func readJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	jsonBlob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	err = json.Unmarshal(jsonBlob, v)
+	if err != nil {
+		return util.WrapError(util.ErrLayoutChanged, err)
+	}
+
+	return nil
+}
+
 func parseFloat(data string) (val float64, err error) {
 	data = strings.Replace(data, ",", ".", 1)
 	f, err := strconv.ParseFloat(data, 64)
@@ -48,30 +85,42 @@ func parseFloat(data string) (val float64, err error) {
 	return f, err
 }
 
-// ParseAccount parses json for account
+// ParseAccount parses json for every account on every card. Balance and
+// Available are from the first account on the selected card, the first
+// card if none is selected.
 func ParseAccount(resp *http.Response, ica *Ica) (*Ica, error) {
-	defer resp.Body.Close()
-	jsonBlob, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ica, err
-	}
 	customer := autoGeneratedCustomer{}
-	err = json.Unmarshal(jsonBlob, &customer)
+	err := readJSON(resp, &customer)
 	if err != nil {
 		return ica, err
 	}
-
-	available, err := parseFloat(customer.Cards[0].Accounts[0].Available)
-	if err != nil {
-		return ica, err
+	ica.Accounts = nil
+	main := -1
+	for _, card := range customer.Cards {
+		for i, a := range card.Accounts {
+			account := Account{}
+			account.Card = card.MaskedCardNumber
+			account.CardType = card.CardTypeDescription
+			account.Name = a.AccountName
+			account.Type = a.AccountType
+			account.Status = a.AccountStatus
+			if account.Available, err = parseFloat(a.Available); err != nil {
+				return ica, util.WrapError(util.ErrLayoutChanged, err)
+			}
+			if account.Balance, err = parseFloat(a.Balance); err != nil {
+				return ica, util.WrapError(util.ErrLayoutChanged, err)
+			}
+			if i == 0 && (main == -1 || card.Selected) {
+				main = len(ica.Accounts)
+			}
+			ica.Accounts = append(ica.Accounts, account)
+		}
 	}
-	ica.Available = available
-	balance, err := parseFloat(customer.Cards[0].Accounts[0].Balance)
-	if err != nil {
-		return ica, err
+	if main == -1 {
+		return ica, util.Errorf(util.ErrLayoutChanged, "No card account in json")
 	}
-
-	ica.Balance = balance
+	ica.Available = ica.Accounts[main].Available
+	ica.Balance = ica.Accounts[main].Balance
 
 	return ica, nil
 }
@@ -79,13 +128,8 @@ func ParseAccount(resp *http.Response, ica *Ica) (*Ica, error) {
 // ParseTransactions parses transactions
 func ParseTransactions(resp *http.Response, ica *Ica) (*Ica, error) {
 	var trans []Transaction
-	defer resp.Body.Close()
-	jsonBlob, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ica, err
-	}
 	transactions := autoGeneratedTransactions{}
-	err = json.Unmarshal(jsonBlob, &transactions)
+	err := readJSON(resp, &transactions)
 	if err != nil {
 		return ica, err
 	}
@@ -106,13 +150,64 @@ func ParseTransactions(resp *http.Response, ica *Ica) (*Ica, error) {
 	return ica, nil
 }
 
+// ParseBonus parses json for the bonus level
+func ParseBonus(resp *http.Response, ica *Ica) (*Ica, error) {
+	bonus := autoGeneratedBonus{}
+	err := readJSON(resp, &bonus)
+	if err != nil {
+		return ica, err
+	}
+	ica.Bonus.Level = bonus.BonusLevel
+	ica.Bonus.Percentage = bonus.BonusPercentage
+	ica.Bonus.Acquired = bonus.AcquiredBonus
+	ica.Bonus.AmountToNextLevel = bonus.AmountToNextLevel
+
+	return ica, nil
+}
+
+// ParseStores parses json for the favorite store ids
+func ParseStores(resp *http.Response) ([]int, error) {
+	stores := autoGeneratedStores{}
+	err := readJSON(resp, &stores)
+
+	return stores.FavoriteStores, err
+}
+
+// ParseOffers parses json for offers
+func ParseOffers(resp *http.Response, ica *Ica) (*Ica, error) {
+	offers := autoGeneratedOffers{}
+	err := readJSON(resp, &offers)
+	if err != nil {
+		return ica, err
+	}
+	ica.Offers = nil
+	for _, o := range offers.Offers {
+		offer := Offer{}
+		offer.ID = o.OfferID
+		offer.Store = o.StoreID
+		offer.Name = strings.TrimSpace(o.ProductName)
+		offer.Condition = strings.TrimSpace(o.OfferCondition)
+		offer.Type = o.OfferType
+		offer.Used = o.OfferUsed
+		if o.ExpirationDate != "" {
+			offer.Expiration, err = time.ParseInLocation("2006-01-02T15:04:05", o.ExpirationDate, time.Local)
+			if err != nil {
+				return ica, util.WrapError(util.ErrLayoutChanged, err)
+			}
+		}
+		ica.Offers = append(ica.Offers, offer)
+	}
+
+	return ica, nil
+}
+
 // ParseHTML parses html
 func ParseHTML(resp *http.Response, ica *Ica) (*Ica, error) {
 	doc, err := goquery.NewDocumentFromResponse(resp)
 	// f, _ := os.Open("out.html")
 	// doc, err := goquery.NewDocumentFromReader(bufio.NewReader(f))
 	if err != nil {
-		return ica, err
+		return ica, util.WrapError(util.ErrUpstreamUnavailable, err)
 	}
 	var available string
 	var balance string
@@ -129,15 +224,18 @@ func ParseHTML(resp *http.Response, ica *Ica) (*Ica, error) {
 		}
 		return true
 	})
+	if available == "" && doc.Find("input[type=\"password\"]").Length() > 0 {
+		return ica, util.Errorf(util.ErrAuthFailed, "Got the login page instead of the account")
+	}
 	amount, err := strconv.ParseFloat(available, 64)
 	if err != nil {
-		return ica, err
+		return ica, util.WrapError(util.ErrLayoutChanged, err)
 	}
 	ica.Available = amount
 
 	bal, err := strconv.ParseFloat(balance, 64)
 	if err != nil {
-		return ica, err
+		return ica, util.WrapError(util.ErrLayoutChanged, err)
 	}
 	ica.Balance = bal
 
@@ -0,0 +1,116 @@
+package ica
+
+import (
+	"context"
+	"flag"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected json in testdata")
+
+// TestParsers replays the fixtures in testdata through the client and
+// the parsers. The fixtures are synthetic, record real ones with
+// fixtures record --site=ica
+func TestParsers(t *testing.T) {
+	// Parsers use local time, keep the expected json stable
+	time.Local = time.UTC
+	tests := []struct {
+		name     string
+		expected string
+		run      func(ctx context.Context, c *Client) (interface{}, error)
+	}{
+		{"html", "expected_html.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			resp, err := c.GetHTML(ctx, "XXX", "XXX")
+			if err != nil {
+				return nil, err
+			}
+
+			return ParseHTML(resp, New("Anders"))
+		}},
+		{"account", "expected_account.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			err := c.Login(ctx, "XXX", "XXX")
+			if err != nil {
+				return nil, err
+			}
+			resp, err := c.GetAccount(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return ParseAccount(resp, New("Anders"))
+		}},
+		{"transactions", "expected_transactions.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			resp, err := c.GetTransactions(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return ParseTransactions(resp, New("Anders"))
+		}},
+		{"fetch", "expected_fetch.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			return c.Fetch(ctx, "XXX", "XXX", New("Anders"))
+		}},
+		{"bonus", "expected_bonus.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			err := c.Login(ctx, "XXX", "XXX")
+			if err != nil {
+				return nil, err
+			}
+			i := New("Anders")
+			resp, err := c.GetTransactions(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if i, err = ParseTransactions(resp, i); err != nil {
+				return nil, err
+			}
+			resp, err = c.GetBonus(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if i, err = ParseBonus(resp, i); err != nil {
+				return nil, err
+			}
+			resp, err = c.GetStores(ctx)
+			if err != nil {
+				return nil, err
+			}
+			stores, err := ParseStores(resp)
+			if err != nil {
+				return nil, err
+			}
+			resp, err = c.GetOffers(ctx, stores)
+			if err != nil {
+				return nil, err
+			}
+			if i, err = ParseOffers(resp, i); err != nil {
+				return nil, err
+			}
+
+			return struct {
+				Ica       *Ica
+				PerMonth  [12]float64
+				PerStore  map[string]float64
+				FavStores []int
+			}{i, i.DiscountPerMonth(2020), i.DiscountPerStore(2020), stores}, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(util.WithTransport(&util.ReplayTransport{Dir: "testdata"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.run(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = util.Golden(path.Join("testdata", tt.expected), got, *update); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package ica
+
+import (
+	"context"
+	"errors"
+
+	"github.com/andersbetner/homeautomation/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Source names, see Ica.Source
+const (
+	API  = "api"
+	HTML = "html"
+)
+
+// Source gets the funds and transactions for an account
+type Source interface {
+	Name() string
+	Fetch(ctx context.Context, user string, password string, ica *Ica) (*Ica, error)
+}
+
+// APISource reads the json app api, the client is logged in afterwards
+type APISource struct {
+	Client *Client
+}
+
+// Name implements Source
+func (s APISource) Name() string {
+	return API
+}
+
+// Fetch implements Source
+func (s APISource) Fetch(ctx context.Context, user string, password string, ica *Ica) (*Ica, error) {
+	err := s.Client.Login(ctx, user, password)
+	if err != nil {
+		return ica, err
+	}
+	resp, err := s.Client.GetAccount(ctx)
+	if err != nil {
+		return ica, err
+	}
+	if ica, err = ParseAccount(resp, ica); err != nil {
+		return ica, err
+	}
+	resp, err = s.Client.GetTransactions(ctx)
+	if err != nil {
+		return ica, err
+	}
+
+	return ParseTransactions(resp, ica)
+}
+
+// HTMLSource scrapes the account page on ica.se
+type HTMLSource struct {
+	Client *Client
+}
+
+// Name implements Source
+func (s HTMLSource) Name() string {
+	return HTML
+}
+
+// Fetch implements Source
+func (s HTMLSource) Fetch(ctx context.Context, user string, password string, ica *Ica) (*Ica, error) {
+	resp, err := s.Client.GetHTML(ctx, user, password)
+	if err != nil {
+		return ica, err
+	}
+
+	return ParseHTML(resp, ica)
+}
+
+// Fetch gets the account from the app api, or scraped if the api fails.
+// The html isn't tried when the api rejects the login.
+func (c *Client) Fetch(ctx context.Context, user string, password string, ica *Ica) (*Ica, error) {
+	return FetchFrom(ctx, []Source{APISource{c}, HTMLSource{c}}, user, password, ica)
+}
+
+// FetchFrom tries sources in order and sets ica.Source to the one that
+// succeeded. An auth error stops the fallback so a bad password doesn't
+// lock the account.
+func FetchFrom(ctx context.Context, sources []Source, user string, password string, ica *Ica) (*Ica, error) {
+	var err error
+	for i, s := range sources {
+		// Every source starts over, a failed one may have set some fields
+		fresh := New(ica.Name)
+		fresh, err = s.Fetch(ctx, user, password, fresh)
+		if err == nil {
+			fresh.Source = s.Name()
+			*ica = *fresh
+			return ica, nil
+		}
+		if errors.Is(err, util.ErrAuthFailed) || ctx.Err() != nil || i == len(sources)-1 {
+			break
+		}
+		log.WithFields(log.Fields{"error": err,
+			"kind":   util.ErrorKind(err),
+			"source": s.Name()}).Warn("Ica source failed, trying the next")
+	}
+
+	return ica, err
+}
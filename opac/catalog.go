@@ -0,0 +1,198 @@
+package opac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// Query is a catalog search, empty fields are ignored
+type Query struct {
+	Text   string `json:"text"` // Free text
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	ISBN   string `json:"isbn"`
+}
+
+// String returns the query in the Arena search syntax
+func (q Query) String() string {
+	var parts []string
+	if q.Text != "" {
+		parts = append(parts, q.Text)
+	}
+	if q.Title != "" {
+		parts = append(parts, "title_index:("+q.Title+")")
+	}
+	if q.Author != "" {
+		parts = append(parts, "author_index:("+q.Author+")")
+	}
+	if q.ISBN != "" {
+		parts = append(parts, "isbn_index:("+strings.Replace(q.ISBN, "-", "", -1)+")")
+	}
+
+	return strings.Join(parts, " AND ")
+}
+
+// Holding is a title at a branch
+type Holding struct {
+	Branch    string `json:"branch"`
+	Status    string `json:"status"` // As on the page eg Utlånad
+	Available bool   `json:"available"`
+}
+
+// SearchResult is a title in the catalog
+type SearchResult struct {
+	Title     string    `json:"title"`
+	Author    string    `json:"author"`
+	RecordID  string    `json:"record_id"`
+	ISBN      string    `json:"isbn"`
+	MediaType string    `json:"media_type"`
+	CoverURL  string    `json:"cover_url"`
+	Holdings  []Holding `json:"holdings"`
+}
+
+// available returns true if a holding status means it's on the shelf
+func available(status string) bool {
+	status = strings.ToLower(status)
+
+	return strings.Contains(status, "tillgänglig") || strings.Contains(status, "hyllan")
+}
+
+// Search searches the catalog, a login isn't needed
+func (s *Client) Search(ctx context.Context, q Query) ([]SearchResult, error) {
+	var results []SearchResult
+	query := q.String()
+	if query == "" {
+		return results, errors.New("Empty search")
+	}
+	params := url.Values{}
+	params.Set("p_p_id", "searchResult_WAR_arenaportlet")
+	params.Set("p_p_lifecycle", "1")
+	params.Set("p_p_state", "normal")
+	params.Set("p_r_p_arena_urn:arena_search_query", query)
+	resp, err := s.get(ctx, s.baseURL+"search?"+params.Encode())
+	if err != nil {
+		return results, err
+	}
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return results, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	list := doc.Find(".arena-search-results")
+	if list.Length() == 0 {
+		return results, util.Errorf(util.ErrLayoutChanged, "Can't find the search results")
+	}
+	list.Find(".arena-record").Each(func(i int, sel *goquery.Selection) {
+		r := SearchResult{}
+		r.Title = strings.TrimSpace(sel.Find(".arena-record-title").Text())
+		r.Author = strings.TrimSpace(sel.Find(".arena-record-author").Find(".arena-value").Text())
+		r.RecordID = recordID(sel)
+		r.ISBN = strings.TrimSpace(sel.Find(".arena-record-isbn").Find(".arena-value").Text())
+		r.MediaType = mediaType(sel.Find(".arena-record-media").Find(".arena-value").Text())
+		r.CoverURL = coverURL(sel, doc.Url)
+		sel.Find(".arena-holding").Each(func(i int, h *goquery.Selection) {
+			holding := Holding{}
+			holding.Branch = strings.TrimSpace(h.Find(".arena-holding-branch").Text())
+			holding.Status = strings.TrimSpace(h.Find(".arena-holding-status").Text())
+			holding.Available = available(holding.Status)
+			r.Holdings = append(r.Holdings, holding)
+		})
+		results = append(results, r)
+	})
+
+	return results, nil
+}
+
+// feedback returns the error message on a page after a form post, nil if
+// the page says it went well
+func feedback(doc *goquery.Document) error {
+	if msg := strings.TrimSpace(doc.Find(".arena-feedback-error").Text()); msg != "" {
+		return errors.New(msg)
+	}
+	if doc.Find(".arena-feedback-success").Length() == 0 {
+		return util.Errorf(util.ErrLayoutChanged, "No feedback after form post")
+	}
+
+	return nil
+}
+
+// Reserve places a reservation for the record with pickup at branch, the
+// default branch is used if branch is empty. Returns the message from
+// the library.
+func (s *Client) Reserve(ctx context.Context, recordID string, branch string) (string, error) {
+	params := url.Values{}
+	params.Set("p_r_p_arena_urn:arena_search_item_id", recordID)
+	resp, err := s.protected(ctx, s.baseURL+"results?"+params.Encode())
+	if err != nil {
+		return "", err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return "", err
+	}
+	form := doc.Find("form.arena-reservation-form")
+	if form.Length() == 0 {
+		return "", util.Errorf(util.ErrLayoutChanged, "Can't find the reservation form for %s", recordID)
+	}
+	post := url.Values{}
+	if branch != "" {
+		selectBranch := form.Find("select")
+		var value string
+		selectBranch.Find("option").Each(func(i int, o *goquery.Selection) {
+			if strings.EqualFold(strings.TrimSpace(o.Text()), branch) || o.AttrOr("value", "") == branch {
+				value = o.AttrOr("value", "")
+			}
+		})
+		if value == "" {
+			return "", fmt.Errorf("Unknown pickup branch %s", branch)
+		}
+		post.Set(selectBranch.AttrOr("name", ""), value)
+	} else if selected := form.Find("select option[selected]"); selected.Length() > 0 {
+		post.Set(form.Find("select").AttrOr("name", ""), selected.AttrOr("value", ""))
+	}
+	doc, err = s.submit(ctx, doc, form, "input.arena-reservation-submit", post)
+	if err != nil {
+		return "", err
+	}
+	if err = feedback(doc); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(doc.Find(".arena-feedback-success").Text()), nil
+}
+
+// CancelReservation cancels the reservation for the record
+func (s *Client) CancelReservation(ctx context.Context, recordID string) error {
+	resp, err := s.reservationsPage(ctx)
+	if err != nil {
+		return err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return err
+	}
+	form := doc.Find("form.arena-reservations-form")
+	if form.Length() == 0 {
+		return util.Errorf(util.ErrLayoutChanged, "Can't find the reservations form")
+	}
+	post := url.Values{}
+	for _, r := range parseReservationPage(doc) {
+		if r.RecordID == recordID && r.cancel != "" {
+			post.Add(r.cancel, r.cancelID)
+		}
+	}
+	if len(post) == 0 {
+		return fmt.Errorf("No reservation for %s", recordID)
+	}
+	doc, err = s.submit(ctx, doc, form, "input.arena-reservations-delete", post)
+	if err != nil {
+		return err
+	}
+
+	return feedback(doc)
+}
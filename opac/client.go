@@ -1,17 +1,22 @@
 package opac
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"io/ioutil"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
-	"golang.org/x/net/publicsuffix"
+	"github.com/andersbetner/homeautomation/util"
+	log "github.com/sirupsen/logrus"
 )
 
-// Client holds a connection to opac
+// Client holds a connection to an Arena opac, gotabiblioteken.se unless
+// util.WithBaseURL is given. The session is kept between calls
+// and the client logs in again when it has expired, see
+// util.WithCookieFile to keep it between restarts too.
 type Client struct {
 	user     string
 	password string
@@ -19,31 +24,108 @@ type Client struct {
 	baseURL  string
 }
 
-// New creates a new Client
-func NewClient(user string, password string) (*Client, error) {
+// NewClient creates a new Client, see util.ClientOption for options
+func NewClient(user string, password string, opts ...util.ClientOption) (*Client, error) {
+	o := util.NewClientOptions(opts...)
 	s := &Client{}
-	s.baseURL = "https://www.gotabiblioteken.se/web/arena/"
+	s.baseURL = o.URL("https://www.gotabiblioteken.se") + "/web/arena/"
 	s.user = user
 	s.password = password
 
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	var err error
+	s.client, err = o.NewHTTPClient()
+
+	return s, err
+}
+
+func (s *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return s, err
+		return nil, err
 	}
 
-	s.client = &http.Client{
-		Jar: jar,
+	return util.CheckResponse(s.client.Do(request))
+}
+
+// loginRequired returns true if resp is the login portlet instead of the
+// page asked for. The body is buffered so resp can still be parsed.
+func loginRequired(resp *http.Response) (bool, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return bytes.Contains(body, []byte(`name="textPassword"`)), nil
+}
+
+// protected gets a page that requires login, logging in again once if
+// the session has expired
+func (s *Client) protected(ctx context.Context, url string) (*http.Response, error) {
+	resp, err := s.get(ctx, url)
+	if err != nil {
+		return resp, err
+	}
+	expired, err := loginRequired(resp)
+	if err != nil || !expired {
+		return resp, err
+	}
+	log.WithField("url", url).Debug("Session expired, logging in again")
+	resp.Body.Close()
+	err = s.Login(ctx)
+	if err != nil {
+		return resp, err
+	}
+
+	return s.get(ctx, url)
+}
+
+// submit posts form on doc with its hidden inputs, the submit button
+// matching button and values, and returns the resulting page
+func (s *Client) submit(ctx context.Context, doc *goquery.Document, form *goquery.Selection, button string, values url.Values) (*goquery.Document, error) {
+	action, ok := form.Attr("action")
+	if !ok {
+		return nil, util.Errorf(util.ErrLayoutChanged, "Can't find the form action")
+	}
+	actionURL, err := doc.Url.Parse(action)
+	if err != nil {
+		return nil, util.WrapError(util.ErrLayoutChanged, err)
+	}
+	post := url.Values{}
+	form.Find("input[type=\"hidden\"]").Each(func(i int, s *goquery.Selection) {
+		post.Add(s.AttrOr("name", ""), s.AttrOr("value", ""))
+	})
+	submit := form.Find(button)
+	if submit.Length() == 0 {
+		return nil, util.Errorf(util.ErrLayoutChanged, "Can't find the button %s", button)
+	}
+	post.Add(submit.AttrOr("name", ""), submit.AttrOr("value", ""))
+	for name, vals := range values {
+		for _, val := range vals {
+			post.Add(name, val)
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", actionURL.String(), strings.NewReader(post.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := util.CheckResponse(s.client.Do(request))
+	if err != nil {
+		return nil, err
 	}
 
-	return s, nil
+	return document(resp)
 }
 
 // Login performs a login
-func (s *Client) Login() error {
-	_, err := s.client.Get(s.baseURL + "welcome")
+func (s *Client) Login(ctx context.Context) error {
+	resp, err := s.get(ctx, s.baseURL+"welcome")
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 	post := url.Values{}
 	post.Set("p_p_id:", "patronLogin_WAR_arenaportlet")
 	post.Set("p_p_lifecycle:", "1")
@@ -55,44 +137,76 @@ func (s *Client) Login() error {
 	post.Set("openTextUsernameContainer:openTextUsername", s.user)
 	post.Set("textPassword", s.password)
 
-	resp, err := s.client.PostForm(
+	request, err := http.NewRequestWithContext(ctx, "POST",
 		s.baseURL+"welcome"+
 			"?p_p_id=patronLogin_WAR_arenaportlet&p_p_lifecycle=1&p_p_state=normal&p_p_mode=view&_patronLogin_WAR_arenaportlet__wu=/patronLogin/?wicket:interface=:0:signInPanel:signInFormPanel:signInForm::IFormSubmitListener::",
-		post)
+		strings.NewReader(post.Encode()))
 	if err != nil {
 		return err
 	}
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = util.CheckResponse(s.client.Do(request))
 	if err != nil {
 		return err
 	}
-	html, err := doc.Html()
+	_, err = document(resp)
 
-	if err != nil {
-		return err
-	}
-	if !strings.Contains(html, "Logga ut") {
-		return errors.New("Can't find text Logga ut on page")
-	}
+	return err
+}
+
+func (s *Client) loansPage(ctx context.Context) (*http.Response, error) {
+
+	return s.protected(ctx, s.baseURL+"protected/loans")
+}
+
+func (s *Client) debtsPage(ctx context.Context) (*http.Response, error) {
+
+	return s.protected(ctx, s.baseURL+"protected/debts")
+}
 
-	return nil
+func (s *Client) reservationsPage(ctx context.Context) (*http.Response, error) {
 
+	return s.protected(ctx, s.baseURL+"protected/reservations")
 }
 
 // Loans returns all loans
-func (s *Client) Loans() (*http.Response, error) {
+func (s *Client) Loans(ctx context.Context) ([]Book, error) {
+	resp, err := s.loansPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return nil, err
+	}
 
-	return s.client.Get(s.baseURL + "protected/loans")
+	return parseLoanPage(doc), nil
 }
 
-// Fee returns fees
-func (s *Client) Fee() (*http.Response, error) {
+// Reservations returns all reservations
+func (s *Client) Reservations(ctx context.Context) ([]Reservation, error) {
+	resp, err := s.reservationsPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return nil, err
+	}
 
-	return s.client.Get(s.baseURL + "protected/debts")
+	return parseReservationPage(doc), nil
 }
 
-// Reservations returns tada
-func (s *Client) Reservations() (*http.Response, error) {
+// Debts returns all debts
+func (s *Client) Debts(ctx context.Context) ([]Debt, error) {
+	resp, err := s.debtsPage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return nil, err
+	}
 
-	return s.client.Get(s.baseURL + "protected/reservations")
+	return parseDebtPage(doc)
 }
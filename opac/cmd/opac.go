@@ -1,34 +1,189 @@
+/*
+mqtt topics
+opac/update (Will update all users, or the user named in the message)
+opac/<name> (Loans, reservations and debts)
+opac/<name>/renew (Renews the loan titled as the message, or all loans on all)
+opac/<name>/renew/result (Which loans were renewed and their new due dates)
+opac/<name>/renew/audit (Every renewal attempt, automatic or requested)
+opac/<name>/search (Catalog search, json {"id", "text", "title", "author", "isbn"})
+opac/<name>/reserve (Place a reservation, json {"id", "record_id", "branch"})
+opac/<name>/cancel (Cancel a reservation, json {"id", "record_id"})
+opac/<name>/<search|reserve|cancel>/result (Response with the id of the request)
+opac/<name>/pickup (A reservation is ready for pickup, sent once per reservation)
+opac/<name>/reminder (A loan is due in a few days or overdue, see users.json)
+opac/<name>/history (Reading log, json {"id", "year"}, 0 is every year)
+opac/<name>/stats (Loans borrowed per month this year, see util.OpacStats)
+opac/<name>/status (Result of the last update, see util.JobStatus)
+
+Loans don't change at night, skip the scheduled updates then with eg
+--quiethours=23-6. Updates requested through mqtt still run.
+*/
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/andersbetner/homeautomation/opac"
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 type user struct {
 	Name     string `json:"name"`
 	User     string `json:"user"`
 	Password string `json:"password"`
+	// Provider is the library system, arena (default) or koha
+	Provider string `json:"provider"`
+	// URL of the library, gotabiblioteken.se for arena if empty
+	URL string `json:"url"`
+	// Reminders are the days before the due date to remind about loans,
+	// 3 and 1 if not set. Overdue loans are always reminded about.
+	Reminders []int `json:"reminders"`
+	// Notify is where notifications for the user are sent besides mqtt
+	Notify []util.NotifierConfig `json:"notify"`
+	// AutoRenew renews books due within this many days, 0 is off
+	AutoRenew int `json:"autorenew"`
+}
+
+// account is a user and its client, kept between runs so the session is
+// reused. mu keeps scheduled updates and mqtt commands from using the
+// session at the same time.
+type account struct {
+	user   user
+	topic  string
+	mu     sync.Mutex
+	client opac.Provider
+	// Books auto renewal has been tried for, see renewalKey
+	attempted map[string]bool
+	history   *opac.History // nil without --historydir
+	notifier  util.Notifiers
+	sent      *util.SentLog // Notifications sent, kept in --statedir
+}
+
+// pickupEvent is published to opac/<name>/pickup and sent to the
+// notifiers
+type pickupEvent struct {
+	Name         string    `json:"name"`
+	Title        string    `json:"title"`
+	RecordID     string    `json:"record_id"`
+	PickupNumber int       `json:"pickup_number"`
+	Branch       string    `json:"branch"`
+	PickupDue    time.Time `json:"pickup_due"`
+	Time         time.Time `json:"time"`
+}
+
+// reminderEvent is published to opac/<name>/reminder and sent to the
+// notifiers
+type reminderEvent struct {
+	Name string `json:"name"`
+	opac.Reminder
+	Time time.Time `json:"time"`
+}
+
+// renewResult is published to opac/<name>/renew/result
+type renewResult struct {
+	Name     string         `json:"name"`
+	Request  string         `json:"request"`
+	Renewals []opac.Renewal `json:"renewals"`
+	Status   string         `json:"status"` // ok or the kind of error, see util.ErrorKind
+	Error    string         `json:"error,omitempty"`
+	Updated  time.Time      `json:"updated"`
+}
+
+// request is the payload of the search, reserve and cancel commands
+type request struct {
+	ID string `json:"id"` // Returned in the response
+	opac.Query
+	RecordID string `json:"record_id"`
+	Branch   string `json:"branch"`
+	Year     int    `json:"year"`
+}
+
+// response is published to opac/<name>/<command>/result
+type response struct {
+	ID      string      `json:"id"`
+	Name    string      `json:"name"`
+	Command string      `json:"command"`
+	Status  string      `json:"status"` // ok or the kind of error, see util.ErrorKind
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+	Updated time.Time   `json:"updated"`
+}
+
+// commands are the mqtt request/response commands by name, a.client is
+// set when they are called
+var commands = map[string]func(ctx context.Context, a *account, req request) (interface{}, error){
+	"search": func(ctx context.Context, a *account, req request) (interface{}, error) {
+		c, err := a.catalog()
+		if err != nil {
+			return nil, err
+		}
+
+		return c.Search(ctx, req.Query)
+	},
+	"reserve": func(ctx context.Context, a *account, req request) (interface{}, error) {
+		c, err := a.catalog()
+		if err != nil {
+			return nil, err
+		}
+
+		return c.Reserve(ctx, req.RecordID, req.Branch)
+	},
+	"cancel": func(ctx context.Context, a *account, req request) (interface{}, error) {
+		c, err := a.catalog()
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, c.CancelReservation(ctx, req.RecordID)
+	},
+	"history": func(ctx context.Context, a *account, req request) (interface{}, error) {
+		if a.history == nil {
+			return nil, errors.New("No history without --historydir")
+		}
+		if req.Year == 0 {
+			return a.history.Events(time.Time{}, time.Now().AddDate(1, 0, 0)), nil
+		}
+		from := time.Date(req.Year, 1, 1, 0, 0, 0, 0, time.Local)
+
+		return a.history.Events(from, from.AddDate(1, 0, 0)), nil
+	},
+}
+
+// renewAudit is published to opac/<name>/renew/audit for every renewal
+// attempt
+type renewAudit struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // auto or mqtt
+	DryRun bool   `json:"dry_run"`
+	opac.Renewal
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
 }
 
 var (
-	mqttHost          string
-	agent             *ag.Agent
-	updateInterval    int
+	daemon            = util.NewDaemon("opac")
 	users             []user
+	accounts          = make(map[string]*account) // By topic
+	clientFlags       util.ClientFlags
+	credentialFlags   util.CredentialFlags
+	sessionDir        string
+	dryRun            bool
+	historyDir        string
+	stateDir          string
+	defaultReminders  = []int{3, 1}
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_sensor_updates_total",
@@ -54,40 +209,97 @@ var (
 			Help: "Library books.",
 		}, []string{"topic"},
 	)
+	promOpacBorrowed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_opac_borrowed",
+			Help: "Library books borrowed this year or month.",
+		}, []string{"period", "topic"},
+	)
 	promOpacFee = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "ab_opac_fee",
 			Help: "Library books fees in SEK",
 		}, []string{"topic"},
 	)
+	promOpacDebt = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_opac_debt",
+			Help: "Library debts in SEK by reason.",
+		}, []string{"reason", "topic"},
+	)
 )
 
-func update() {
-	for _, user := range users {
-		var err error
-		topic := strings.ToLower(user.Name)
-		c, err := opac.NewClient(user.User, user.Password)
+// getClient returns the client for a, created on first use with the
+// session saved in --sessiondir if set. Call with a.mu held.
+func (a *account) getClient() (opac.Provider, error) {
+	if a.client != nil {
+		return a.client, nil
+	}
+	opts := clientFlags.Options()
+	if a.user.URL != "" {
+		opts = append(opts, util.WithBaseURL(a.user.URL))
+	}
+	if sessionDir != "" {
+		opts = append(opts, util.WithCookieFile(path.Join(sessionDir, a.topic+".json")))
+	}
+	c, err := opac.NewProvider(a.user.Provider, a.user.User, a.user.Password, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a.client = c
+
+	return c, nil
+}
+
+// catalog returns the client if its provider has a catalog. Call with
+// a.mu held after getClient.
+func (a *account) catalog() (opac.Catalog, error) {
+	c, ok := a.client.(opac.Catalog)
+	if !ok {
+		return nil, fmt.Errorf("No catalog search in opac provider %s", a.user.Provider)
+	}
+
+	return c, nil
+}
+
+// update returns a job that publishes loans, reservations and fees for
+// the account. The client logs in when needed.
+func update(a *account) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		topic := a.topic
+		c, err := a.getClient()
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "opac",
 				"topic": topic}).Error("Error create client")
-			continue
-		}
-		if err = c.Login(); err != nil {
-			log.WithFields(log.Fields{"error": err,
-				"type":  "opac",
-				"topic": topic}).Error("Error login")
-			continue
+			return err
 		}
-		o := opac.New(user.Name)
+		o := opac.New(a.user.Name)
 
-		o, err = opac.Parse(c, o)
+		o, err = opac.Parse(ctx, c, o)
 
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "opac",
+				"kind":  util.ErrorKind(err),
 				"topic": topic}).Error("Error parsing opac body")
-			continue
+			return err
+		}
+		if a.user.AutoRenew > 0 {
+			autoRenew(ctx, a, c, o)
+		}
+		notifyPickups(ctx, a, o)
+		notifyReminders(ctx, a, o)
+		err = a.sent.Prune(time.Now().AddDate(0, 0, -90))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":  "opac",
+				"topic": topic}).Error("Error save sent notifications")
+		}
+		if a.history != nil {
+			updateHistory(a, o)
 		}
 		bookCount := float64(len(o.Books))
 		reservationCount := float64(len(o.Reservations))
@@ -104,93 +316,505 @@ func update() {
 		}
 		promOpacReservationPickup.WithLabelValues(topic).Set(reservationPickup)
 		promOpacFee.WithLabelValues(topic).Set(o.Fee)
+		debts := o.DebtPerReason()
+		for _, reason := range opac.Debts {
+			promOpacDebt.WithLabelValues(reason, topic).Set(debts[reason])
+		}
 		out, err := json.Marshal(o)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "opac",
 				"topic": topic}).Error("Error marshal json")
+			return err
 		}
-		err = agent.Publish("opac/"+topic, true, string(out))
+		err = daemon.Publish("opac/"+topic, true, string(out))
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "opac",
 				"topic": topic}).Error("Error publish opac")
+			return err
+		}
+		log.WithFields(log.Fields{
+			"topic": topic}).Debug("Publish opac")
+
+		return nil
+	}
+}
+
+// notify publishes n.Data to opac/<name>/<n.Type> and sends n to every
+// notifier, once per key. Delivery is saved per notifier so a failing
+// notifier is tried again next run without repeating the others. Call
+// with a.mu held.
+func notify(ctx context.Context, a *account, key string, n util.Notification) {
+	if !a.sent.Sent(key) {
+		out, err := json.Marshal(n.Data)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":  "opac",
+				"topic": a.topic}).Error("Error marshal json")
+			return
+		}
+		err = daemon.Publish("opac/"+a.topic+"/"+n.Type, false, string(out))
+		if err != nil {
+			// Tried again next run
+			log.WithFields(log.Fields{"error": err,
+				"type":  "opac",
+				"topic": a.topic}).Error("Error publish " + n.Type)
+			return
+		}
+		log.WithFields(log.Fields{"subject": n.Subject,
+			"topic": a.topic}).Info("Notify " + n.Type)
+		err = a.sent.Add(key, n.Time)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":  "opac",
+				"topic": a.topic}).Error("Error save sent notifications")
+		}
+	}
+	for i, notifier := range a.notifier {
+		notifierKey := key + " notifier " + strconv.Itoa(i)
+		if a.sent.Sent(notifierKey) {
+			continue
+		}
+		err := notifier.Notify(ctx, n)
+		if err != nil {
+			// Not marked as sent, tried again next run
+			log.WithFields(log.Fields{"error": err,
+				"type":     "opac",
+				"notifier": i,
+				"topic":    a.topic}).Error("Error notify " + n.Type)
+			continue
+		}
+		err = a.sent.Add(notifierKey, n.Time)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"type":  "opac",
+				"topic": a.topic}).Error("Error save sent notifications")
+		}
+	}
+}
+
+// notifyPickups notifies the reservations that have got a pickup
+// number, once per reservation and pickup number. Call with a.mu held.
+func notifyPickups(ctx context.Context, a *account, o *opac.Opac) {
+	now := time.Now()
+	for _, r := range o.Reservations {
+		if r.PickupNumber == 0 {
+			continue
+		}
+		id := r.RecordID
+		if id == "" {
+			id = r.Title
+		}
+		event := pickupEvent{}
+		event.Name = a.user.Name
+		event.Title = r.Title
+		event.RecordID = r.RecordID
+		event.PickupNumber = r.PickupNumber
+		event.Branch = r.Branch
+		event.PickupDue = r.PickupDue
+		event.Time = now
+		msg := fmt.Sprintf("Hämta %s, nummer %d", r.Title, r.PickupNumber)
+		if r.Branch != "" {
+			msg += " på " + r.Branch
+		}
+		if r.PickupDue.Year() > 1 {
+			msg += " senast " + r.PickupDue.Format("2006-01-02")
+		}
+		n := util.Notification{}
+		n.Name = a.user.Name
+		n.Type = "pickup"
+		n.Subject = "Reservation att hämta: " + r.Title
+		n.Message = msg
+		n.Data = event
+		n.Time = now
+		notify(ctx, a, "pickup "+id+" "+strconv.Itoa(r.PickupNumber), n)
+	}
+}
+
+// notifyReminders sends escalating reminders for the loans due soon or
+// overdue, once per level and due date. Call with a.mu held after
+// autoRenew so renewed books aren't reminded about.
+func notifyReminders(ctx context.Context, a *account, o *opac.Opac) {
+	days := a.user.Reminders
+	if days == nil {
+		days = defaultReminders
+	}
+	now := time.Now()
+	for _, r := range opac.Reminders(o.Books, days, now) {
+		event := reminderEvent{}
+		event.Name = a.user.Name
+		event.Reminder = r
+		event.Time = now
+		var msg string
+		switch {
+		case r.DaysLeft < 0:
+			msg = fmt.Sprintf("%s skulle ha lämnats tillbaka %s", r.Title, r.DateDue.Format("2006-01-02"))
+		case r.DaysLeft == 0:
+			msg = fmt.Sprintf("%s ska lämnas tillbaka i dag", r.Title)
+		default:
+			msg = fmt.Sprintf("%s ska lämnas tillbaka om %d dagar, %s", r.Title, r.DaysLeft, r.DateDue.Format("2006-01-02"))
+		}
+		if r.Renewable {
+			msg += ". Den kan lånas om."
 		} else {
-			log.WithFields(log.Fields{
-				"topic": topic}).Debug("Publish opac")
+			msg += ". Den kan inte lånas om."
 		}
+		n := util.Notification{}
+		n.Name = a.user.Name
+		n.Type = "reminder"
+		n.Subject = "Lämna tillbaka: " + r.Title
+		if r.Level == opac.Overdue {
+			n.Subject = "Försenad: " + r.Title
+		}
+		n.Message = msg
+		n.Data = event
+		n.Time = now
+		notify(ctx, a, r.Key(), n)
 	}
 }
 
-func init() {
-	log.SetLevel(log.DebugLevel)
-	prometheus.MustRegister(promUpdateCounter)
-	prometheus.MustRegister(promOpac)
-	prometheus.MustRegister(promOpacDue)
-	prometheus.MustRegister(promOpacReservationPickup)
-	prometheus.MustRegister(promOpacFee)
+// updateHistory records borrowed and returned books and publishes the
+// stats for this year. Call with a.mu held.
+func updateHistory(a *account, o *opac.Opac) {
+	now := time.Now()
+	events, err := a.history.Update(o, now)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error update history")
+		return
+	}
+	for _, e := range events {
+		log.WithFields(log.Fields{"title": e.Title,
+			"event": e.Type,
+			"topic": a.topic}).Info("History")
+	}
+	stats := util.OpacStats{}
+	stats.Name = a.user.Name
+	stats.Year = now.Year()
+	stats.Months = a.history.BorrowedPerMonth(stats.Year)
+	for _, n := range stats.Months {
+		stats.Total += n
+	}
+	stats.Updated = now
+	promOpacBorrowed.WithLabelValues("year", a.topic).Set(float64(stats.Total))
+	promOpacBorrowed.WithLabelValues("month", a.topic).Set(float64(stats.Months[now.Month()-1]))
+	out, err := json.Marshal(stats)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error marshal json")
+		return
+	}
+	err = daemon.Publish("opac/"+a.topic+"/stats", true, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error publish stats")
+	}
+}
 
-	var configFile string
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
-	flag.StringVar(&configFile, "config", "", "full path to configfile eg --config=/etc/users.json ")
-	flag.IntVar(&updateInterval, "updateinterval", 30, "integer > 0")
-	flag.Parse()
-	exit := false
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
+// audit publishes a renewal attempt
+func audit(a *account, source string, renewal opac.Renewal, err error) {
+	entry := renewAudit{}
+	entry.Name = a.user.Name
+	entry.Source = source
+	entry.DryRun = dryRun && source == "auto"
+	entry.Renewal = renewal
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	entry.Time = time.Now()
+	log.WithFields(log.Fields{"title": renewal.Title,
+		"source":   source,
+		"dry_run":  entry.DryRun,
+		"renewed":  renewal.Renewed,
+		"date_due": renewal.DateDue,
+		"error":    entry.Error,
+		"topic":    a.topic}).Info("Renew")
+	out, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error marshal json")
+		return
 	}
-	if configFile == "" {
-		os.Stderr.WriteString("--config missing eg --config=/etc/users.json\n")
-		exit = true
+	err = daemon.Publish("opac/"+a.topic+"/renew/audit", false, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error publish renew audit")
 	}
+}
 
-	if exit {
-		os.Exit(1)
+// renewalKey identifies a loan and its due date in account.attempted
+func renewalKey(book opac.Book) string {
+	return book.RecordID + " " + book.DateDue.Format("2006-01-02")
+}
+
+// transient returns true if err kept a renewal from getting through, eg
+// the site being down, rather than the site refusing it
+func transient(ctx context.Context, err error) bool {
+	return ctx.Err() != nil ||
+		errors.Is(err, util.ErrUpstreamUnavailable) ||
+		errors.Is(err, util.ErrAuthFailed) ||
+		errors.Is(err, util.ErrLayoutChanged)
+}
+
+// autoRenew renews the renewable books due within AutoRenew days and
+// updates their due dates in o. Every book is tried once per due date, so
+// a refused renewal isn't retried every run, renewals that didn't get
+// through are tried again next run. Call with a.mu held.
+func autoRenew(ctx context.Context, a *account, c opac.Provider, o *opac.Opac) {
+	// Forget returned loans and due dates that have moved
+	loans := make(map[string]bool)
+	for _, book := range o.Books {
+		loans[renewalKey(book)] = true
+	}
+	for key := range a.attempted {
+		if !loans[key] {
+			delete(a.attempted, key)
+		}
+	}
+	var due []opac.Book
+	var titles []string
+	for _, book := range o.RenewableDue(time.Now().AddDate(0, 0, a.user.AutoRenew)) {
+		if a.attempted[renewalKey(book)] {
+			continue
+		}
+		due = append(due, book)
+		titles = append(titles, book.Title)
+	}
+	if len(due) == 0 {
+		return
+	}
+	var renewals []opac.Renewal
+	var err error
+	if !dryRun {
+		renewals, err = c.Renew(ctx, titles...)
+	}
+	for _, book := range due {
+		renewal := opac.Renewal{}
+		renewal.Title = book.Title
+		renewal.RecordID = book.RecordID
+		renewal.DateDue = book.DateDue
+		renewal.PreviousDue = book.DateDue
+		renewErr := err
+		for _, r := range renewals {
+			if r.RecordID == book.RecordID {
+				renewal = r
+				renewErr = nil
+			}
+		}
+		audit(a, "auto", renewal, renewErr)
+		if renewErr == nil || !transient(ctx, renewErr) {
+			a.attempted[renewalKey(book)] = true
+		}
+	}
+	for i, book := range o.Books {
+		for _, r := range renewals {
+			if r.Renewed && r.RecordID == book.RecordID {
+				o.Books[i].DateDue = r.DateDue
+			}
+		}
 	}
+}
 
-	jsonStr, err := ioutil.ReadFile(configFile)
+// renew renews the loan titled request, or every renewable loan if
+// request is all, and publishes the result
+func renew(ctx context.Context, a *account, request string) {
+	result := renewResult{}
+	result.Name = a.user.Name
+	result.Request = request
+	a.mu.Lock()
+	c, err := a.getClient()
+	if err == nil {
+		if strings.EqualFold(request, "all") {
+			result.Renewals, err = c.Renew(ctx)
+		} else {
+			result.Renewals, err = c.Renew(ctx, request)
+		}
+	}
+	a.mu.Unlock()
+	for _, r := range result.Renewals {
+		audit(a, "mqtt", r, nil)
+	}
+	if len(result.Renewals) == 0 {
+		audit(a, "mqtt", opac.Renewal{Title: request}, err)
+	}
+	result.Status = util.ErrorKind(err)
 	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("Can't read %s\n", configFile))
-		os.Stderr.WriteString(err.Error() + "\n")
-		os.Exit(1)
+		result.Error = err.Error()
+		log.WithFields(log.Fields{"error": err,
+			"type":    "opac",
+			"kind":    result.Status,
+			"request": request,
+			"topic":   a.topic}).Error("Error renew")
 	}
-	err = json.Unmarshal([]byte(jsonStr), &users)
+	result.Updated = time.Now()
+	out, err := json.Marshal(result)
 	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("Can't unmarshal json in %s\n", configFile))
-		os.Stderr.WriteString(err.Error() + "\n")
-		os.Exit(1)
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error marshal json")
+		return
+	}
+	err = daemon.Publish("opac/"+a.topic+"/renew/result", false, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error publish renew result")
 	}
+	// Publish the new due dates
+	daemon.Scheduler.Trigger(a.topic)
+}
 
+// renewHandler handles opac/<name>/renew, the payload is a title or all
+func renewHandler(client mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	a, ok := accounts[parts[1]]
+	if !ok {
+		log.WithField("topic", msg.Topic()).Warn("Renew for unknown user")
+		return
+	}
+	request := strings.TrimSpace(string(msg.Payload()))
+	if request == "" {
+		log.WithField("topic", msg.Topic()).Warn("Renew without title, send a title or all")
+		return
+	}
+	daemon.Go(func(ctx context.Context) {
+		renew(ctx, a, request)
+	})
 }
 
-func main() {
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("prometheus", ":9100", prometheusMux)
-	host, err := os.Hostname()
+// command runs a command for the account and publishes the response
+func command(ctx context.Context, a *account, name string, req request) {
+	resp := response{}
+	resp.ID = req.ID
+	resp.Name = a.user.Name
+	resp.Command = name
+	a.mu.Lock()
+	_, err := a.getClient()
+	if err == nil {
+		resp.Result, err = commands[name](ctx, a, req)
+	}
+	a.mu.Unlock()
+	resp.Status = util.ErrorKind(err)
 	if err != nil {
-		host = "opac"
+		resp.Error = err.Error()
+		log.WithFields(log.Fields{"error": err,
+			"type":    "opac",
+			"kind":    resp.Status,
+			"command": name,
+			"topic":   a.topic}).Error("Error " + name)
 	}
-	agent = ag.NewAgent(mqttHost, "opac-"+host)
-	err = agent.Connect()
+	resp.Updated = time.Now()
+	out, err := json.Marshal(resp)
 	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error marshal json")
+		return
+	}
+	err = daemon.Publish("opac/"+a.topic+"/"+name+"/result", false, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "opac",
+			"topic": a.topic}).Error("Error publish " + name + " result")
 	}
-	// agent.Subscribe("opac/update", updateHandler)
-	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
-		log.Info("Shutting down opac")
-		time.Sleep(2 * time.Second)
-		os.Exit(0)
-	}()
+	if (name == "reserve" || name == "cancel") && resp.Status == "ok" {
+		// Publish the new reservations
+		daemon.Scheduler.Trigger(a.topic)
+	}
+}
 
-	for !agent.IsTerminated() {
-		update()
-		time.Sleep(time.Duration(updateInterval) * time.Minute)
+// commandHandler handles opac/<name>/<command> for the commands above
+func commandHandler(client mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	a, ok := accounts[parts[1]]
+	if !ok {
+		log.WithField("topic", msg.Topic()).Warn("Command for unknown user")
+		return
+	}
+	name := parts[2]
+	req := request{}
+	err := json.Unmarshal(msg.Payload(), &req)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"topic": msg.Topic()}).Warn("Can't unmarshal command json")
+		return
 	}
+	daemon.Go(func(ctx context.Context) {
+		command(ctx, a, name, req)
+	})
+}
 
+func init() {
+	prometheus.MustRegister(promUpdateCounter)
+	prometheus.MustRegister(promOpac)
+	prometheus.MustRegister(promOpacDue)
+	prometheus.MustRegister(promOpacReservationPickup)
+	prometheus.MustRegister(promOpacFee)
+	prometheus.MustRegister(promOpacDebt)
+	prometheus.MustRegister(promOpacBorrowed)
+
+	daemon.Scheduled = true
+	daemon.ConfigExample = "/etc/users.json"
+	flag.BoolVar(&dryRun, "dryrun", false, "only log and audit what autorenew in users.json would renew")
+	flag.StringVar(&historyDir, "historydir", "", "keep the reading log in this dir eg --historydir=/var/lib/opac")
+	flag.StringVar(&stateDir, "statedir", "", "keep sent notifications in this dir between restarts eg --statedir=/var/lib/opac")
+	flag.StringVar(&sessionDir, "sessiondir", "", "keep login sessions in this dir between restarts eg --sessiondir=/var/lib/opac")
+	clientFlags.Register()
+	credentialFlags.Register()
+	if daemon.ParseFlags() {
+		os.Exit(1)
+	}
+	daemon.LoadConfig(&users)
+	for _, user := range users {
+		topic := strings.ToLower(user.Name)
+		// Without a password in users.json, eg OPAC_ANDERS_PASSWORD
+		c, err := credentialFlags.Lookup("opac/"+topic, util.Credentials{User: user.User, Password: user.Password})
+		if err != nil {
+			os.Stderr.WriteString("Credentials for " + user.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		user.User = c.User
+		user.Password = c.Password
+		a := &account{user: user, topic: topic}
+		a.attempted = make(map[string]bool)
+		if historyDir != "" {
+			var err error
+			a.history, err = opac.OpenHistory(path.Join(historyDir, a.topic+".jsonl"))
+			if err != nil {
+				os.Stderr.WriteString("Can't load history for " + user.Name + ": " + err.Error() + "\n")
+				os.Exit(1)
+			}
+		}
+		sentFile := ""
+		if stateDir != "" {
+			sentFile = path.Join(stateDir, a.topic+"-sent.json")
+		}
+		a.sent, err = util.OpenSentLog(sentFile)
+		if err != nil {
+			os.Stderr.WriteString("Can't load sent notifications for " + user.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		a.notifier, err = util.NewNotifiers(user.Notify)
+		if err != nil {
+			os.Stderr.WriteString("Notify for " + user.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		accounts[a.topic] = a
+		daemon.Schedule(&util.Job{Name: a.topic, Run: update(a)})
+	}
+}
+
+func main() {
+	daemon.Subscribe("opac/update", daemon.Scheduler.TriggerHandler())
+	daemon.Subscribe("opac/+/renew", renewHandler)
+	for name := range commands {
+		daemon.Subscribe("opac/+/"+name, commandHandler)
+	}
+	daemon.Run()
 }
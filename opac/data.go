@@ -8,6 +8,14 @@ type Book struct {
 	DateDue     time.Time `json:"date_due"`
 	LibraryName string    `json:"library_name"`
 	Renewable   bool      `json:"renewable"`
+	Author      string    `json:"author"`
+	RecordID    string    `json:"record_id"`
+	ISBN        string    `json:"isbn"`
+	MediaType   string    `json:"media_type"` // book, audiobook, ebook, dvd or as on the page
+	DateLoaned  time.Time `json:"date_loaned"`
+	CoverURL    string    `json:"cover_url"`
+	renewal     string    // Name of the renewal checkbox
+	renewalID   string    // Value of the renewal checkbox
 }
 
 // Reservation yada
@@ -17,15 +25,39 @@ type Reservation struct {
 	BooksTotal   int       `json:"books_total"`
 	PickupDue    time.Time `json:"pickup_due"`
 	PickupNumber int       `json:"pickup_number"`
+	RecordID     string    `json:"record_id"`
+	Branch       string    `json:"branch"` // Pickup branch
+	cancel       string    // Name of the cancel checkbox
+	cancelID     string    // Value of the cancel checkbox
+}
+
+// Debt reasons
+const (
+	LateFee        = "late_fee"
+	LostItem       = "lost_item"
+	ReservationFee = "reservation_fee"
+	OtherFee       = "other"
+)
+
+// Debts are the reasons in the order they are shown
+var Debts = []string{LateFee, LostItem, ReservationFee, OtherFee}
+
+// Debt is a fee owed to the library
+type Debt struct {
+	Title  string    `json:"title"`
+	Reason string    `json:"reason"` // LateFee, LostItem, ReservationFee or OtherFee
+	Date   time.Time `json:"date"`
+	Amount float64   `json:"amount"` // SEK
 }
 
 // Opac holds library loans
 type Opac struct {
 	Name         string        `json:"name"`
-	Fee          float64       `json:"fee"`
+	Fee          float64       `json:"fee"` // Sum of Debts
 	Updated      time.Time     `json:"updated"`
 	Books        []Book        `json:"books"`
 	Reservations []Reservation `json:"reservations"`
+	Debts        []Debt        `json:"debts"`
 }
 
 // New returns a new Opac
@@ -49,6 +81,26 @@ func (o *Opac) FirstDue() (book Book) {
 	return book
 }
 
+// RenewableDue returns the renewable books due before t
+func (o *Opac) RenewableDue(t time.Time) (books []Book) {
+	for _, b := range o.Books {
+		if b.Renewable && b.DateDue.Before(t) {
+			books = append(books, b)
+		}
+	}
+	return books
+}
+
+// DebtPerReason returns the sum of the debts by reason
+func (o *Opac) DebtPerReason() map[string]float64 {
+	sums := make(map[string]float64)
+	for _, d := range o.Debts {
+		sums[d.Reason] += d.Amount
+	}
+
+	return sums
+}
+
 // ReservationPickup returns true if any book reserved is due for pickup
 func (o *Opac) ReservationPickup() bool {
 	for _, r := range o.Reservations {
@@ -0,0 +1,172 @@
+package opac
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// Event types
+const (
+	Borrowed = "borrowed"
+	Returned = "returned"
+)
+
+// Event is a loan that was borrowed or returned
+type Event struct {
+	Type        string    `json:"type"` // Borrowed or Returned
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	RecordID    string    `json:"record_id"`
+	MediaType   string    `json:"media_type"`
+	LibraryName string    `json:"library_name"`
+	DateLoaned  time.Time `json:"date_loaned"`
+	Date        time.Time `json:"date"` // Borrowed or returned, when first seen if unknown
+}
+
+// key identifies a loan, a book borrowed again is a new loan
+func (e Event) key() string {
+	id := e.RecordID
+	if id == "" {
+		id = e.Title
+	}
+
+	return id + " " + e.DateLoaned.Format("2006-01-02")
+}
+
+func bookEvent(eventType string, b Book, date time.Time) Event {
+	e := Event{}
+	e.Type = eventType
+	e.Title = b.Title
+	e.Author = b.Author
+	e.RecordID = b.RecordID
+	e.MediaType = b.MediaType
+	e.LibraryName = b.LibraryName
+	e.DateLoaned = b.DateLoaned
+	e.Date = date
+
+	return e
+}
+
+// History is the reading log for one user, the borrow and return events
+// found by comparing consecutive Opac snapshots. Events are appended to
+// File as json lines.
+type History struct {
+	File   string
+	mu     sync.Mutex
+	events []Event
+}
+
+// OpenHistory loads the events in file, a missing file gives an empty
+// history. A last line cut short by a crash is dropped, see
+// util.ReadJSONLines.
+func OpenHistory(file string) (*History, error) {
+	h := &History{}
+	h.File = file
+	err := util.ReadJSONLines(file, func(line []byte) error {
+		e := Event{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		h.events = append(h.events, e)
+
+		return nil
+	})
+
+	return h, err
+}
+
+// loans returns the loans that are borrowed and not returned
+func (h *History) loans() map[string]Event {
+	loans := make(map[string]Event)
+	for _, e := range h.events {
+		if e.Type == Borrowed {
+			loans[e.key()] = e
+		} else {
+			delete(loans, e.key())
+		}
+	}
+
+	return loans
+}
+
+// Update compares the loans in o with the loans in the history, saves
+// and returns the new events. Returns are dated now, loans without a
+// loan date are dated now too.
+func (h *History) Update(o *Opac, now time.Time) ([]Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []Event
+	loans := h.loans()
+	current := make(map[string]bool)
+	for _, b := range o.Books {
+		date := b.DateLoaned
+		if date.IsZero() {
+			date = now
+		}
+		e := bookEvent(Borrowed, b, date)
+		current[e.key()] = true
+		if _, ok := loans[e.key()]; !ok {
+			events = append(events, e)
+		}
+	}
+	for key, e := range loans {
+		if current[key] {
+			continue
+		}
+		e.Type = Returned
+		e.Date = now
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		return events, nil
+	}
+	f, err := os.OpenFile(h.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+		// Kept once written, a failed write is tried again next update
+		h.events = append(h.events, e)
+	}
+
+	return events, f.Close()
+}
+
+// Events returns the events dated from and up to, not including, to
+func (h *History) Events(from time.Time, to time.Time) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []Event
+	for _, e := range h.events {
+		if !e.Date.Before(from) && e.Date.Before(to) {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// BorrowedPerMonth returns the number of loans borrowed per month in year
+func (h *History) BorrowedPerMonth(year int) (months [12]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.events {
+		if e.Type == Borrowed && e.Date.Year() == year {
+			months[e.Date.Month()-1]++
+		}
+	}
+
+	return months
+}
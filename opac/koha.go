@@ -0,0 +1,383 @@
+package opac
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// kohaItemTypes maps the default Koha item types to media types
+var kohaItemTypes = map[string]string{
+	"BK":  "book",
+	"AB":  "audiobook",
+	"EB":  "ebook",
+	"DVD": "dvd",
+}
+
+// kohaDebitTypes maps the Koha debit type codes to debt reasons
+var kohaDebitTypes = map[string]string{
+	"OVERDUE": LateFee,
+	"LOST":    LostItem,
+	"RESERVE": ReservationFee,
+}
+
+type kohaBiblio struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	ISBN   string `json:"isbn"`
+}
+
+type kohaCheckout struct {
+	ID           int    `json:"checkout_id"`
+	DueDate      string `json:"due_date"`
+	CheckoutDate string `json:"checkout_date"`
+	Item         struct {
+		BiblioID   int        `json:"biblio_id"`
+		ItemTypeID string     `json:"item_type_id"`
+		Biblio     kohaBiblio `json:"biblio"`
+	} `json:"item"`
+	Library struct {
+		Name string `json:"name"`
+	} `json:"library"`
+}
+
+type kohaHold struct {
+	ID             int        `json:"hold_id"`
+	BiblioID       int        `json:"biblio_id"`
+	Priority       int        `json:"priority"`
+	Status         string     `json:"status"` // W is waiting for pickup
+	ExpirationDate string     `json:"expiration_date"`
+	Biblio         kohaBiblio `json:"biblio"`
+	PickupLibrary  struct {
+		Name string `json:"name"`
+	} `json:"pickup_library"`
+}
+
+// KohaClient holds a connection to the Koha REST api. Every request uses
+// basic auth, so RESTBasicAuth must be enabled in Koha.
+type KohaClient struct {
+	user     string
+	password string
+	client   *http.Client
+	baseURL  string
+	patronID int
+}
+
+// NewKohaClient creates a new KohaClient, util.WithBaseURL is required
+func NewKohaClient(user string, password string, opts ...util.ClientOption) (*KohaClient, error) {
+	o := util.NewClientOptions(opts...)
+	s := &KohaClient{}
+	s.baseURL = o.URL("")
+	if s.baseURL == "" {
+		return s, errors.New("Koha needs a base url")
+	}
+	s.baseURL += "/api/v1/"
+	s.user = user
+	s.password = password
+
+	var err error
+	s.client, err = o.NewHTTPClient()
+
+	return s, err
+}
+
+func (s *KohaClient) do(ctx context.Context, method string, url string, body interface{}, embed string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(s.user, s.password)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if embed != "" {
+		request.Header.Set("x-koha-embed", embed)
+	}
+
+	return s.client.Do(request)
+}
+
+// loggedOut forgets the patron id if err is ErrAuthFailed, eg after a
+// password change, so the next call logs in again
+func (s *KohaClient) loggedOut(err error) error {
+	if errors.Is(err, util.ErrAuthFailed) {
+		s.patronID = 0
+	}
+
+	return err
+}
+
+// get unmarshals the json at url into v
+func (s *KohaClient) get(ctx context.Context, url string, embed string, v interface{}) error {
+	resp, err := util.CheckResponse(s.do(ctx, "GET", url, nil, embed))
+	if err != nil {
+		return s.loggedOut(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return util.WrapError(util.ErrLayoutChanged, err)
+	}
+
+	return nil
+}
+
+// kohaDate returns the day of a Koha date or date-time
+func kohaDate(str string) time.Time {
+	if len(str) < 10 {
+		return time.Time{}
+	}
+	t, err := parseDate(str[:10])
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// Login validates the password and looks up the patron id. Koha answers
+// a wrong password with 400, 401 or 403 depending on version.
+func (s *KohaClient) Login(ctx context.Context) error {
+	body := map[string]string{"identifier": s.user, "password": s.password}
+	resp, err := s.do(ctx, "POST", s.baseURL+"auth/password/validation", body, "")
+	if err == nil && (resp.StatusCode == http.StatusBadRequest ||
+		resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		resp.Body.Close()
+		return util.Errorf(util.ErrAuthFailed, "Password validation failed with %s", resp.Status)
+	}
+	resp, err = util.CheckResponse(resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return util.Errorf(util.ErrLayoutChanged, "Password validation returned %s", resp.Status)
+	}
+	patron := struct {
+		PatronID int `json:"patron_id"`
+	}{}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	if err = json.Unmarshal(data, &patron); err != nil || patron.PatronID == 0 {
+		return util.Errorf(util.ErrLayoutChanged, "No patron id after login")
+	}
+	s.patronID = patron.PatronID
+
+	return nil
+}
+
+// login logs in if it hasn't been done yet or the last call failed with
+// ErrAuthFailed
+func (s *KohaClient) login(ctx context.Context) error {
+	if s.patronID != 0 {
+		return nil
+	}
+
+	return s.Login(ctx)
+}
+
+func (s *KohaClient) checkouts(ctx context.Context) ([]kohaCheckout, error) {
+	var checkouts []kohaCheckout
+	if err := s.login(ctx); err != nil {
+		return checkouts, err
+	}
+	url := fmt.Sprintf("%scheckouts?patron_id=%d&_per_page=-1", s.baseURL, s.patronID)
+	err := s.get(ctx, url, "item.biblio,library", &checkouts)
+
+	return checkouts, err
+}
+
+func (s *KohaClient) renewable(ctx context.Context, checkoutID int) (bool, error) {
+	allows := struct {
+		AllowsRenewal bool `json:"allows_renewal"`
+	}{}
+	err := s.get(ctx, fmt.Sprintf("%scheckouts/%d/allows_renewal", s.baseURL, checkoutID), "", &allows)
+
+	return allows.AllowsRenewal, err
+}
+
+func kohaBook(c kohaCheckout, renewable bool) Book {
+	book := Book{}
+	book.Title = c.Item.Biblio.Title
+	book.Author = c.Item.Biblio.Author
+	book.ISBN = c.Item.Biblio.ISBN
+	book.RecordID = strconv.Itoa(c.Item.BiblioID)
+	book.MediaType = kohaItemTypes[c.Item.ItemTypeID]
+	if book.MediaType == "" {
+		book.MediaType = strings.ToLower(c.Item.ItemTypeID)
+	}
+	book.LibraryName = c.Library.Name
+	book.DateDue = kohaDate(c.DueDate)
+	book.DateLoaned = kohaDate(c.CheckoutDate)
+	book.Renewable = renewable
+
+	return book
+}
+
+// Loans returns all loans
+func (s *KohaClient) Loans(ctx context.Context) ([]Book, error) {
+	var books []Book
+	checkouts, err := s.checkouts(ctx)
+	if err != nil {
+		return books, err
+	}
+	for _, c := range checkouts {
+		renewable, err := s.renewable(ctx, c.ID)
+		if err != nil {
+			return books, err
+		}
+		books = append(books, kohaBook(c, renewable))
+	}
+
+	return books, nil
+}
+
+// Reservations returns all holds. Koha has no pickup numbers, waiting
+// holds get the hold id as PickupNumber.
+func (s *KohaClient) Reservations(ctx context.Context) ([]Reservation, error) {
+	var reservations []Reservation
+	if err := s.login(ctx); err != nil {
+		return reservations, err
+	}
+	var holds []kohaHold
+	url := fmt.Sprintf("%sholds?patron_id=%d&_per_page=-1", s.baseURL, s.patronID)
+	if err := s.get(ctx, url, "biblio,pickup_library", &holds); err != nil {
+		return reservations, err
+	}
+	for _, h := range holds {
+		reservation := Reservation{}
+		reservation.Title = h.Biblio.Title
+		reservation.RecordID = strconv.Itoa(h.BiblioID)
+		reservation.QuePosition = h.Priority
+		reservation.Branch = h.PickupLibrary.Name
+		if h.Status == "W" {
+			reservation.PickupNumber = h.ID
+			reservation.PickupDue = kohaDate(h.ExpirationDate)
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, nil
+}
+
+// Debts returns the outstanding debits on the account
+func (s *KohaClient) Debts(ctx context.Context) ([]Debt, error) {
+	var debts []Debt
+	if err := s.login(ctx); err != nil {
+		return debts, err
+	}
+	account := struct {
+		Debits struct {
+			Lines []struct {
+				Outstanding float64 `json:"amount_outstanding"`
+				Date        string  `json:"date"`
+				Type        string  `json:"debit_type_code"`
+				Description string  `json:"description"`
+			} `json:"lines"`
+		} `json:"outstanding_debits"`
+	}{}
+	err := s.get(ctx, fmt.Sprintf("%spatrons/%d/account", s.baseURL, s.patronID), "", &account)
+	if err != nil {
+		return debts, err
+	}
+	for _, line := range account.Debits.Lines {
+		debt := Debt{}
+		debt.Title = line.Description
+		debt.Reason = kohaDebitTypes[line.Type]
+		if debt.Reason == "" {
+			debt.Reason = OtherFee
+		}
+		debt.Date = kohaDate(line.Date)
+		debt.Amount = line.Outstanding
+		debts = append(debts, debt)
+	}
+
+	return debts, nil
+}
+
+// Renew renews the loans with titles, case is ignored. Every renewable
+// loan is renewed if no title is given.
+func (s *KohaClient) Renew(ctx context.Context, titles ...string) ([]Renewal, error) {
+	var renewals []Renewal
+	checkouts, err := s.checkouts(ctx)
+	if err != nil {
+		return renewals, err
+	}
+	for _, c := range checkouts {
+		selected := len(titles) == 0
+		for _, title := range titles {
+			if strings.EqualFold(c.Item.Biblio.Title, strings.TrimSpace(title)) {
+				selected = true
+			}
+		}
+		if !selected {
+			continue
+		}
+		renewable, err := s.renewable(ctx, c.ID)
+		if err != nil {
+			return renewals, err
+		}
+		if !renewable {
+			continue
+		}
+		renewal := Renewal{}
+		renewal.Title = c.Item.Biblio.Title
+		renewal.RecordID = strconv.Itoa(c.Item.BiblioID)
+		renewal.PreviousDue = kohaDate(c.DueDate)
+		renewal.DateDue = renewal.PreviousDue
+		resp, err := s.do(ctx, "POST", fmt.Sprintf("%scheckouts/%d/renewal", s.baseURL, c.ID), nil, "")
+		if err == nil && resp.StatusCode == http.StatusForbidden {
+			// Renewal refused, eg reserved by someone else
+			resp.Body.Close()
+			renewals = append(renewals, renewal)
+			continue
+		}
+		resp, err = util.CheckResponse(resp, err)
+		if err != nil {
+			return renewals, s.loggedOut(err)
+		}
+		renewed := struct {
+			DueDate string `json:"due_date"`
+		}{}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return renewals, util.WrapError(util.ErrUpstreamUnavailable, err)
+		}
+		if err = json.Unmarshal(data, &renewed); err != nil {
+			return renewals, util.WrapError(util.ErrLayoutChanged, err)
+		}
+		renewal.DateDue = kohaDate(renewed.DueDate)
+		renewal.Renewed = renewal.DateDue.After(renewal.PreviousDue)
+		renewals = append(renewals, renewal)
+	}
+	if len(titles) > 0 && len(renewals) == 0 {
+		return renewals, fmt.Errorf("No renewable loan with title %s", strings.Join(titles, ", "))
+	}
+
+	return renewals, nil
+}
@@ -1,70 +1,136 @@
 package opac
 
 import (
+	"context"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
 )
 
+// document parses resp and checks that it's a page for a logged in user.
+// The login form gives ErrAuthFailed, a page without Logga ut gives
+// ErrLayoutChanged.
+func document(resp *http.Response) (*goquery.Document, error) {
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return doc, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	if doc.Find("input[type=\"password\"]").Length() > 0 {
+		return doc, util.Errorf(util.ErrAuthFailed, "Got the login form at %s", resp.Request.URL.Path)
+	}
+	if !strings.Contains(doc.Text(), "Logga ut") {
+		return doc, util.Errorf(util.ErrLayoutChanged, "Can't find text Logga ut on %s", resp.Request.URL.Path)
+	}
+
+	return doc, nil
+}
+
 func parseDate(str string) (time.Time, error) {
 	t, error := time.Parse("2006-01-02", str)
 	ret := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Now().Location())
 	return ret, error
 }
-func parseBook(s *goquery.Selection, renewable bool) Book {
+
+// mediaTypes maps the media types on the page to short names
+var mediaTypes = map[string]string{
+	"bok":       "book",
+	"ljudbok":   "audiobook",
+	"e-bok":     "ebook",
+	"e-ljudbok": "audiobook",
+	"dvd":       "dvd",
+}
+
+func mediaType(str string) string {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if t, ok := mediaTypes[str]; ok {
+		return t
+	}
+
+	return str
+}
+
+// recordID returns the catalog id from the title link in a record
+func recordID(s *goquery.Selection) string {
+	href, ok := s.Find(".arena-record-title a").Attr("href")
+	if !ok {
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+
+	return u.Query().Get("p_r_p_arena_urn:arena_search_item_id")
+}
+
+// coverURL returns the absolute url of the book jacket in a record
+func coverURL(s *goquery.Selection, page *url.URL) string {
+	src, ok := s.Find(".arena-book-jacket img").Attr("src")
+	if !ok || page == nil {
+		return ""
+	}
+	u, err := page.Parse(src)
+	if err != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+// parseBook parses a loan, page is the url of the loans page and used
+// for the cover url
+func parseBook(s *goquery.Selection, renewable bool, page *url.URL) Book {
 	book := Book{}
 	book.Renewable = renewable
 	book.Title = strings.TrimSpace(s.Find(".arena-record-title").Text())
 	tmp := s.Find(".arena-renewal-branch").Find(".arena-value").Text()
 	re := regexp.MustCompile(`\d{4}-\d\d-\d\d`)
 	book.LibraryName = strings.TrimSpace(re.ReplaceAllString(tmp, ""))
-	tmp = s.Find(".arena-renewal-date").Find(".arena-renewal-date-value").Text()
 	var err error
+	if loaned := re.FindString(tmp); loaned != "" {
+		book.DateLoaned, err = parseDate(loaned)
+	}
+	tmp = s.Find(".arena-renewal-date").Find(".arena-renewal-date-value").Text()
 	book.DateDue, err = parseDate(tmp)
 	if err != nil {
 		// log error here
 	}
+	book.Author = strings.TrimSpace(s.Find(".arena-record-author").Find(".arena-value").Text())
+	book.ISBN = strings.TrimSpace(s.Find(".arena-record-isbn").Find(".arena-value").Text())
+	book.MediaType = mediaType(s.Find(".arena-record-media").Find(".arena-value").Text())
+	book.RecordID = recordID(s)
+	book.CoverURL = coverURL(s, page)
+	checkbox := s.Find("input[type=\"checkbox\"]")
+	book.renewal = checkbox.AttrOr("name", "")
+	book.renewalID = checkbox.AttrOr("value", "")
 
 	return book
 }
 
-func parseLoans(client *Client) ([]Book, error) {
+func parseLoanPage(doc *goquery.Document) []Book {
 	var books []Book
-	resp, err := client.Loans()
-	if err != nil {
-		return books, err
-	}
-	doc, err := goquery.NewDocumentFromResponse(resp)
-	if err != nil {
-		return books, err
-	}
-
 	doc.Find(".arena-renewal-true").Each(func(i int, s *goquery.Selection) {
-		books = append(books, parseBook(s, true))
+		books = append(books, parseBook(s, true, doc.Url))
 	})
 	doc.Find(".arena-renewal-false").Each(func(i int, s *goquery.Selection) {
-		books = append(books, parseBook(s, false))
+		books = append(books, parseBook(s, false, doc.Url))
 	})
 
-	return books, nil
+	return books
 }
 
-func parseReservations(client *Client) ([]Reservation, error) {
+func parseReservationPage(doc *goquery.Document) []Reservation {
 	var reservations []Reservation
-	resp, err := client.Reservations()
-	if err != nil {
-		return reservations, err
-	}
-	doc, err := goquery.NewDocumentFromResponse(resp)
-	if err != nil {
-		return reservations, err
-	}
 	doc.Find(".arena-record").Each(func(i int, s *goquery.Selection) {
 		reservation := Reservation{}
 		reservation.Title = strings.TrimSpace(s.Find(".arena-record-title").Text())
+		reservation.RecordID = recordID(s)
 
 		que := strings.TrimSpace(s.Find(".arena-record-queue").Find(".arena-value").Text())
 		re := regexp.MustCompile(`(\d+).*av (\d+) exemplar`)
@@ -80,62 +146,94 @@ func parseReservations(client *Client) ([]Reservation, error) {
 		}
 
 		dueDate := strings.TrimSpace(s.Find(".arena-record-expire").Find(".arena-value").Text())
-		reservation.PickupDue, err = parseDate(dueDate)
+		reservation.PickupDue, _ = parseDate(dueDate)
 
-		reservation.PickupNumber, err = strconv.Atoi(s.Find(".arena-record-pickup").Find(".arena-value").Text())
+		reservation.PickupNumber, _ = strconv.Atoi(s.Find(".arena-record-pickup").Find(".arena-value").Text())
+		reservation.Branch = strings.TrimSpace(s.Find(".arena-record-branch").Find(".arena-value").Text())
+		checkbox := s.Find("input[type=\"checkbox\"]")
+		reservation.cancel = checkbox.AttrOr("name", "")
+		reservation.cancelID = checkbox.AttrOr("value", "")
 
 		reservations = append(reservations, reservation)
 	})
 
-	return reservations, nil
+	return reservations
 }
 
-func parseFee(client *Client) (float64, error) {
-	var fee float64
-	var err error
-	resp, err := client.Fee()
-	if err != nil {
-		return fee, err
+// debtReason returns the reason for a debt type or title on the page
+func debtReason(str string) string {
+	str = strings.ToLower(str)
+	switch {
+	case strings.Contains(str, "försen"):
+		return LateFee
+	case strings.Contains(str, "förkom"), strings.Contains(str, "ersättning"), strings.Contains(str, "borttapp"):
+		return LostItem
+	case strings.Contains(str, "reserv"):
+		return ReservationFee
 	}
-	doc, err := goquery.NewDocumentFromResponse(resp)
-	if err != nil {
-		return fee, err
-	}
-	doc.Find(".arena-debts-amount").EachWithBreak(func(i int, s *goquery.Selection) bool {
-		str := strings.TrimSpace(strings.Replace(s.Text(), ",", ".", 1))
-		if str != "" {
-			var val float64
-			val, err = strconv.ParseFloat(str, 64)
-			if err != nil {
-				return false
-			}
-			fee += val
+
+	return OtherFee
+}
+
+func parseDebtPage(doc *goquery.Document) ([]Debt, error) {
+	var debts []Debt
+	var err error
+	doc.Find(".arena-debts tr").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		str := strings.TrimSpace(strings.Replace(s.Find(".arena-debts-amount").Text(), ",", ".", 1))
+		if str == "" {
+			return true
+		}
+		debt := Debt{}
+		debt.Amount, err = strconv.ParseFloat(str, 64)
+		if err != nil {
+			err = util.WrapError(util.ErrLayoutChanged, err)
+			return false
+		}
+		debt.Title = strings.TrimSpace(s.Find(".arena-debts-title").Text())
+		reason := strings.TrimSpace(s.Find(".arena-debts-type").Text())
+		if reason == "" {
+			reason = debt.Title
+		}
+		debt.Reason = debtReason(reason)
+		if date := strings.TrimSpace(s.Find(".arena-debts-date").Text()); date != "" {
+			debt.Date, _ = parseDate(date)
 		}
+		debts = append(debts, debt)
 		return true
 	})
-
 	if err != nil {
-		return fee, err
+		return debts, err
+	}
+	// Every amount on the page must be in a debt row, or the fee is wrong
+	amounts := doc.Find(".arena-debts-amount").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return strings.TrimSpace(s.Text()) != ""
+	}).Length()
+	if amounts != len(debts) {
+		return debts, util.Errorf(util.ErrLayoutChanged, "Found %d debt amounts but %d debt rows", amounts, len(debts))
 	}
 
-	return fee, nil
+	return debts, nil
 }
 
-// Parse parses opac loan data
-func Parse(client *Client, opac *Opac) (*Opac, error) {
+// Parse fills in opac with the loans, reservations and debts from provider
+func Parse(ctx context.Context, provider Provider, opac *Opac) (*Opac, error) {
 	var err error
-	opac.Books, err = parseLoans(client)
+	opac.Books, err = provider.Loans(ctx)
 	if err != nil {
 		return opac, err
 	}
-	opac.Reservations, err = parseReservations(client)
+	opac.Reservations, err = provider.Reservations(ctx)
 	if err != nil {
 		return opac, err
 	}
-	opac.Fee, err = parseFee(client)
+	opac.Debts, err = provider.Debts(ctx)
 	if err != nil {
 		return opac, err
 	}
+	opac.Fee = 0
+	for _, d := range opac.Debts {
+		opac.Fee += d.Amount
+	}
 
 	return opac, nil
 }
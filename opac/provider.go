@@ -0,0 +1,45 @@
+package opac
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// Provider is a library system backend
+type Provider interface {
+	Login(ctx context.Context) error
+	Loans(ctx context.Context) ([]Book, error)
+	Reservations(ctx context.Context) ([]Reservation, error)
+	Debts(ctx context.Context) ([]Debt, error)
+	// Renew renews the loans with titles, every renewable loan if none
+	Renew(ctx context.Context, titles ...string) ([]Renewal, error)
+}
+
+// Catalog is implemented by providers that can search the catalog and
+// place reservations
+type Catalog interface {
+	Search(ctx context.Context, q Query) ([]SearchResult, error)
+	Reserve(ctx context.Context, recordID string, branch string) (string, error)
+	CancelReservation(ctx context.Context, recordID string) error
+}
+
+// Provider names, see NewProvider
+const (
+	Arena = "arena"
+	Koha  = "koha"
+)
+
+// NewProvider returns the provider called name, Arena if name is empty.
+// Use util.WithBaseURL for a library on another host.
+func NewProvider(name string, user string, password string, opts ...util.ClientOption) (Provider, error) {
+	switch name {
+	case "", Arena:
+		return NewClient(user, password, opts...)
+	case Koha:
+		return NewKohaClient(user, password, opts...)
+	}
+
+	return nil, fmt.Errorf("Unknown opac provider %s", name)
+}
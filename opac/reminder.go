@@ -0,0 +1,81 @@
+package opac
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Overdue is the Reminder.Level of a book past its due date
+const Overdue = -1
+
+// Reminder is a notice that a loan is due soon or overdue
+type Reminder struct {
+	Title     string    `json:"title"`
+	RecordID  string    `json:"record_id"`
+	DateDue   time.Time `json:"date_due"`
+	Renewable bool      `json:"renewable"`
+	DaysLeft  int       `json:"days_left"` // Negative when overdue
+	Level     int       `json:"level"`     // Days before due the reminder is for, or Overdue
+}
+
+// Key identifies the reminder, it's the same for every run until the
+// book is due for the next level or gets a new due date
+func (r Reminder) Key() string {
+	id := r.RecordID
+	if id == "" {
+		id = r.Title
+	}
+
+	return "reminder " + id + " " + r.DateDue.Format("2006-01-02") + " " + strconv.Itoa(r.Level)
+}
+
+// daysLeft returns the number of days from the day of now to due
+func daysLeft(due time.Time, now time.Time) int {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, now.Location())
+
+	return int(math.Round(day.Sub(today).Hours() / 24))
+}
+
+// reminderLevel returns the first of the sorted levels that left days is
+// within, false if none
+func reminderLevel(left int, levels []int) (int, bool) {
+	if left < 0 {
+		return Overdue, true
+	}
+	for _, d := range levels {
+		if left <= d {
+			return d, true
+		}
+	}
+
+	return 0, false
+}
+
+// Reminders returns a reminder for every book due within one of days, eg
+// 3 and 1 days before, or overdue at now. The level is the closest of
+// days, so a book due tomorrow gets the 1 day reminder and not the 3 day.
+func Reminders(books []Book, days []int, now time.Time) []Reminder {
+	levels := append([]int{}, days...)
+	sort.Ints(levels)
+	var reminders []Reminder
+	for _, b := range books {
+		left := daysLeft(b.DateDue, now)
+		level, ok := reminderLevel(left, levels)
+		if !ok {
+			continue
+		}
+		r := Reminder{}
+		r.Title = b.Title
+		r.RecordID = b.RecordID
+		r.DateDue = b.DateDue
+		r.Renewable = b.Renewable
+		r.DaysLeft = left
+		r.Level = level
+		reminders = append(reminders, r)
+	}
+
+	return reminders
+}
@@ -0,0 +1,108 @@
+package opac
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// Renewal is the result of renewing one loan
+type Renewal struct {
+	Title       string    `json:"title"`
+	RecordID    string    `json:"record_id"`
+	Renewed     bool      `json:"renewed"`
+	DateDue     time.Time `json:"date_due"` // After the renewal
+	PreviousDue time.Time `json:"previous_due"`
+}
+
+// RenewAll renews every renewable loan
+func (s *Client) RenewAll(ctx context.Context) ([]Renewal, error) {
+	return s.renew(ctx, func(book Book) bool {
+		return true
+	})
+}
+
+// Renew renews the loans with titles, case is ignored. Every renewable
+// loan is renewed if no title is given.
+func (s *Client) Renew(ctx context.Context, titles ...string) ([]Renewal, error) {
+	if len(titles) == 0 {
+		return s.RenewAll(ctx)
+	}
+	renewals, err := s.renew(ctx, func(book Book) bool {
+		for _, title := range titles {
+			if strings.EqualFold(book.Title, strings.TrimSpace(title)) {
+				return true
+			}
+		}
+		return false
+	})
+	if err == nil && len(renewals) == 0 {
+		return renewals, fmt.Errorf("No renewable loan with title %s", strings.Join(titles, ", "))
+	}
+
+	return renewals, err
+}
+
+// renewKey identifies a loan across the renewal post, the list can be
+// reordered when due dates change so the checkbox name won't do
+func renewKey(book Book) string {
+	if book.RecordID != "" {
+		return book.RecordID
+	}
+
+	return book.Title
+}
+
+// renew ticks the renewal checkbox for the renewable loans matching
+// selected and posts the renewal form on the loans page. A loan counts as
+// renewed if its due date moved.
+func (s *Client) renew(ctx context.Context, selected func(Book) bool) ([]Renewal, error) {
+	var renewals []Renewal
+	resp, err := s.loansPage(ctx)
+	if err != nil {
+		return renewals, err
+	}
+	doc, err := document(resp)
+	if err != nil {
+		return renewals, err
+	}
+	form := doc.Find("form.arena-renewal-form")
+	if form.Length() == 0 {
+		return renewals, util.Errorf(util.ErrLayoutChanged, "Can't find the renewal form")
+	}
+	post := url.Values{}
+	before := make(map[string]Book)
+	for _, book := range parseLoanPage(doc) {
+		if !book.Renewable || book.renewal == "" || !selected(book) {
+			continue
+		}
+		post.Add(book.renewal, book.renewalID)
+		before[renewKey(book)] = book
+	}
+	if len(before) == 0 {
+		return renewals, nil
+	}
+	doc, err = s.submit(ctx, doc, form, "input.arena-renewal-selected", post)
+	if err != nil {
+		return renewals, err
+	}
+	for _, book := range parseLoanPage(doc) {
+		old, ok := before[renewKey(book)]
+		if !ok {
+			continue
+		}
+		renewal := Renewal{}
+		renewal.Title = book.Title
+		renewal.RecordID = book.RecordID
+		renewal.Renewed = book.DateDue.After(old.DateDue)
+		renewal.DateDue = book.DateDue
+		renewal.PreviousDue = old.DateDue
+		renewals = append(renewals, renewal)
+	}
+
+	return renewals, nil
+}
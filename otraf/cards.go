@@ -0,0 +1,198 @@
+package otraf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Card is a travel card linked to the account
+type Card struct {
+	Number   string    `json:"number"` // Empty when scraped
+	Nickname string    `json:"nickname"`
+	Products []Product `json:"products"`
+	Updated  time.Time `json:"updated"` // When the card was last synced
+}
+
+// Otraf returns the card as an Otraf for name
+func (c Card) Otraf(name string) *Otraf {
+	o := New(name)
+	o.SetProducts(c.Products)
+	o.CardUpdated = c.Updated
+
+	return o
+}
+
+type apiCard struct {
+	CardNumber   string  `json:"CardNumber"`
+	CardNickName string  `json:"CardNickName"`
+	Balance      float64 `json:"Balance"`
+	Periods      []struct {
+		ProductName string `json:"ProductName"`
+		Zone        string `json:"Zone"`
+		ValidFrom   string `json:"ValidFrom"`
+		ValidTo     string `json:"ValidTo"`
+	} `json:"Periods"`
+	Tickets []struct {
+		ProductName    string `json:"ProductName"`
+		Zone           string `json:"Zone"`
+		RemainingTrips int    `json:"RemainingTrips"`
+		ValidTo        string `json:"ValidTo"` // Empty if it doesn't expire
+	} `json:"Tickets"`
+	LastUpdated string `json:"LastUpdated"`
+}
+
+// parseAPITime parses the local times in the card json eg
+// 2020-02-01T00:00:00
+func parseAPITime(str string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", str, time.Local)
+	if err != nil {
+		return t, util.WrapError(util.ErrLayoutChanged, err)
+	}
+
+	return t, nil
+}
+
+// APICards returns the cards linked to the account from the json card
+// endpoint. Call Login first.
+func (client *Client) APICards(ctx context.Context) ([]Card, error) {
+	var cards []Card
+	r, err := http.NewRequestWithContext(ctx, "GET", client.siteURL+"/ajax2/store/cardclient/getcards", nil)
+	if err != nil {
+		return cards, err
+	}
+	r.Header.Set("Accept", "application/json")
+	resp, err := client.do(r)
+	if err != nil {
+		return cards, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cards, util.Errorf(util.ErrLayoutChanged, "Card api returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return cards, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	var apiCards []apiCard
+	err = json.Unmarshal(body, &apiCards)
+	if err != nil {
+		return cards, util.WrapError(util.ErrLayoutChanged, err)
+	}
+	for _, a := range apiCards {
+		card := Card{}
+		card.Number = a.CardNumber
+		card.Nickname = strings.TrimSpace(a.CardNickName)
+		value := Product{Type: Value, Name: "Reskassa"}
+		value.Value = int(math.Round(a.Balance))
+		card.Products = append(card.Products, value)
+		for _, p := range a.Periods {
+			period := Product{Type: PeriodPass, Name: p.ProductName, Zone: p.Zone}
+			if period.Start, err = parseAPITime(p.ValidFrom); err != nil {
+				return cards, err
+			}
+			if period.End, err = parseAPITime(p.ValidTo); err != nil {
+				return cards, err
+			}
+			card.Products = append(card.Products, period)
+		}
+		for _, t := range a.Tickets {
+			trips := Product{Type: Trips, Name: t.ProductName, Zone: t.Zone, Trips: t.RemainingTrips}
+			if t.ValidTo != "" {
+				if trips.End, err = parseAPITime(t.ValidTo); err != nil {
+					return cards, err
+				}
+			}
+			card.Products = append(card.Products, trips)
+		}
+		if a.LastUpdated != "" {
+			if card.Updated, err = parseAPITime(a.LastUpdated); err != nil {
+				return cards, err
+			}
+		}
+		cards = append(cards, card)
+	}
+
+	return cards, nil
+}
+
+// cardFromOtraf returns the card scraped into o
+func cardFromOtraf(nickname string, o *Otraf) Card {
+	card := Card{}
+	card.Nickname = nickname
+	card.Products = o.Products
+	card.Updated = o.CardUpdated
+
+	return card
+}
+
+// HTMLCards scrapes the cards from the card overview, one tab at a time.
+// Call Login first.
+func (client *Client) HTMLCards(ctx context.Context) ([]Card, error) {
+	var cards []Card
+	resp, err := client.overview(ctx)
+	if err != nil {
+		return cards, err
+	}
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return cards, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	var tabs []string
+	doc.Find("#form1cardOverviewTabs").Find("span").Each(func(i int, s *goquery.Selection) {
+		tabs = append(tabs, strings.TrimSpace(s.Text()))
+	})
+	// The overview shows the first card
+	o, err := parseDocument(doc, &Otraf{})
+	if err != nil {
+		return cards, err
+	}
+	if len(tabs) == 0 {
+		return append(cards, cardFromOtraf("", o)), nil
+	}
+	cards = append(cards, cardFromOtraf(tabs[0], o))
+	for _, tab := range tabs[1:] {
+		// Every click posts the view state from the page before it
+		resp, err := client.clickTab(ctx, doc, tab)
+		if err != nil {
+			return cards, err
+		}
+		doc, err = applyResponse(doc, resp)
+		if err != nil {
+			return cards, err
+		}
+		o, err = parseDocument(doc, &Otraf{})
+		if err != nil {
+			return cards, err
+		}
+		cards = append(cards, cardFromOtraf(tab, o))
+	}
+
+	return cards, nil
+}
+
+// Cards logs in and returns every card linked to the account, from the
+// card api or scraped if the api fails
+func (client *Client) Cards(ctx context.Context, user string, password string) ([]Card, error) {
+	err := client.Login(ctx, user, password)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := client.APICards(ctx)
+	if err == nil || errors.Is(err, util.ErrAuthFailed) || ctx.Err() != nil {
+		return cards, err
+	}
+	log.WithFields(log.Fields{"error": err,
+		"kind": util.ErrorKind(err)}).Warn("Card api failed, scraping the cards")
+
+	return client.HTMLCards(ctx)
+}
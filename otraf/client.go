@@ -1,48 +1,118 @@
 package otraf
 
 import (
-	"errors"
-	"fmt"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
-
+	"github.com/andersbetner/homeautomation/util"
 	"golang.org/x/net/publicsuffix"
 )
 
-// GetHTML fetches the page for a user and returns a http.Response
-func GetHTML(user string, password string, tab string) (resp *http.Response, err error) {
+// Client connects to ostgotatrafiken.se
+type Client struct {
+	client     *http.Client
+	session    *http.Client // Set by Login
+	siteURL    string
+	webtickURL string
+}
+
+// NewClient creates a new Client, see util.ClientOption for options
+func NewClient(opts ...util.ClientOption) (*Client, error) {
+	o := util.NewClientOptions(opts...)
+	c := &Client{}
+	c.siteURL = o.URL("https://www.ostgotatrafiken.se")
+	c.webtickURL = o.URL("https://webtick.ostgotatrafiken.se")
+	var err error
+	c.client, err = o.NewHTTPClient()
+
+	return c, err
+}
+
+// loginAttempt is posted to log in
+type loginAttempt struct {
+	AuthSource            int    `json:"authSource"`
+	KeepMeLimitedLoggedIn bool   `json:"keepMeLimitedLoggedIn"`
+	UserName              string `json:"userName"`
+	Password              string `json:"password"`
+	ImpersonateUserName   string `json:"impersonateUserName"`
+}
+
+// Login starts a new session, every login gets a new cookie jar
+func (client *Client) Login(ctx context.Context, user string, password string) error {
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
-		return resp, err
-	}
-	c := &http.Client{
-		Jar: jar,
+		return err
 	}
+	c := *client.client
+	c.Jar = jar
 
 	// POSTDATA=={"authSource":10,"keepMeLimitedLoggedIn":true,
 	// "userName":"XXX","password":"XXX","impersonateUserName":""}
-	post := `={"authSource":10,"keepMeLimitedLoggedIn":true,`
-	post += fmt.Sprintf(`"userName":"%s","password":"%s","impersonateUserName":""}`, user, password)
-	poster := strings.NewReader(post)
-	_, err = c.Post("https://www.ostgotatrafiken.se/ajax/Login/Attempt",
-		"application/x-www-form-urlencoded;charset=UTF-8", poster)
+	attempt := loginAttempt{AuthSource: 10, KeepMeLimitedLoggedIn: true, UserName: user, Password: password}
+	post, err := json.Marshal(attempt)
 	if err != nil {
-		return resp, err
+		return err
 	}
-	// resp, err = c.Get("https://www.ostgotatrafiken.se/ajax2/store/cardclient/getcards")
-	resp, err = c.Get("https://webtick.ostgotatrafiken.se/webtick/user/pages/CardOverview.iface")
-	if tab == "" {
-		return resp, err
+	// The json is the value of a form field without a name
+	poster := strings.NewReader("=" + url.QueryEscape(string(post)))
+	r, err := http.NewRequestWithContext(ctx, "POST", client.siteURL+"/ajax/Login/Attempt", poster)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	resp, err := util.CheckResponse(c.Do(r))
+	if err != nil {
+		return err
+	}
+	login := struct {
+		Success *bool
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&login)
+	resp.Body.Close()
+	if err != nil {
+		return util.WrapError(util.ErrLayoutChanged, err)
+	}
+	if login.Success == nil {
+		return util.Errorf(util.ErrLayoutChanged, "No Success in the login response")
 	}
+	if !*login.Success {
+		return util.Errorf(util.ErrAuthFailed, "Login attempt not successful")
+	}
+	client.session = &c
 
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	return nil
+}
+
+// do runs request in the session from Login
+func (client *Client) do(request *http.Request) (*http.Response, error) {
+	if client.session == nil {
+		return nil, util.Errorf(util.ErrAuthFailed, "Not logged in")
+	}
+
+	return util.CheckResponse(client.session.Do(request))
+}
+
+// overview returns the card overview page, it shows the first card
+func (client *Client) overview(ctx context.Context) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, "GET", client.webtickURL+"/webtick/user/pages/CardOverview.iface", nil)
 	if err != nil {
-		return resp, err
+		return nil, err
 	}
+
+	return client.do(r)
+}
+
+// clickTab replays the ICEfaces click on the tab for a card on the
+// overview page doc and returns the card
+func (client *Client) clickTab(ctx context.Context, doc *goquery.Document, tab string) (*http.Response, error) {
 	form := url.Values{}
 	doc.Find("#formLinkedCardRequests").Find("input").Each(func(i int, s *goquery.Selection) {
 		// Should be these inputs
@@ -69,7 +139,10 @@ func GetHTML(user string, password string, tab string) (resp *http.Response, err
 		}
 	})
 	if tabID == "" {
-		return resp, errors.New("Can't find span id for tab:" + tab)
+		if doc.Find("input[type=\"password\"]").Length() > 0 {
+			return nil, util.Errorf(util.ErrAuthFailed, "Got the login form instead of the cards")
+		}
+		return nil, util.Errorf(util.ErrLayoutChanged, "Can't find span id for tab: %s", tab)
 	}
 	tabID += "Link"
 	// form.Add("ice.event.target", tabID)
@@ -96,10 +169,123 @@ func GetHTML(user string, password string, tab string) (resp *http.Response, err
 	form.Add("javax.faces.partial.event", "click")
 	form.Add("javax.faces.partial.execute", "@all")
 	form.Add("javax.faces.partial.render", "@all")
-	resp, err = c.PostForm("https://webtick.ostgotatrafiken.se/webtick/user/pages/CardOverview.iface", form)
+	r, err := http.NewRequestWithContext(ctx, "POST", client.webtickURL+"/webtick/user/pages/CardOverview.iface", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return client.do(r)
+}
+
+// partialResponse is the JSF answer to an ajax click, the parts of the
+// page that changed
+type partialResponse struct {
+	Updates []struct {
+		ID      string `xml:"id,attr"`
+		Content string `xml:",chardata"`
+	} `xml:"changes>update"`
+}
+
+// readPartial returns the partial response in body, nil if body is a
+// whole page
+func readPartial(body []byte) (*partialResponse, error) {
+	if !bytes.Contains(body, []byte("<partial-response")) {
+		return nil, nil
+	}
+	p := &partialResponse{}
+	if err := xml.Unmarshal(body, p); err != nil {
+		return nil, util.WrapError(util.ErrLayoutChanged, err)
+	}
+
+	return p, nil
+}
+
+// isViewState returns true if the update id is the JSF view state, eg
+// javax.faces.ViewState or j_id1:javax.faces.ViewState:0
+func isViewState(id string) bool {
+	return strings.Contains(id, "javax.faces.ViewState")
+}
+
+// responseDocument returns the page in resp, the changed parts if it's a
+// partial response
+func responseDocument(resp *http.Response) (*goquery.Document, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	p, err := readPartial(body)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		var html string
+		for _, u := range p.Updates {
+			if !isViewState(u.ID) {
+				html += u.Content
+			}
+		}
+		body = []byte("<html><body>" + html + "</body></html>")
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, util.WrapError(util.ErrLayoutChanged, err)
+	}
+
+	return doc, nil
+}
+
+// applyResponse returns doc after a click answered with resp. A partial
+// response is applied to doc, the view state and the changed elements,
+// so the next click posts the current state.
+func applyResponse(doc *goquery.Document, resp *http.Response) (*goquery.Document, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return doc, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	p, err := readPartial(body)
+	if err != nil {
+		return doc, err
+	}
+	if p == nil {
+		doc, err = goquery.NewDocumentFromReader(bytes.NewReader(body))
+		if err != nil {
+			return doc, util.WrapError(util.ErrLayoutChanged, err)
+		}
+		return doc, nil
+	}
+	for _, u := range p.Updates {
+		if isViewState(u.ID) {
+			doc.Find(`input[name="javax.faces.ViewState"]`).SetAttr("value", strings.TrimSpace(u.Content))
+			continue
+		}
+		element := doc.Find(`[id="` + u.ID + `"]`)
+		if element.Length() == 0 {
+			return doc, util.Errorf(util.ErrLayoutChanged, "Can't find element %s to update", u.ID)
+		}
+		element.ReplaceWithHtml(u.Content)
+	}
+
+	return doc, nil
+}
+
+// GetHTML logs in and returns the page for the card on tab, the first
+// card if tab is empty. Prefer Cards, this is the fallback.
+func (client *Client) GetHTML(ctx context.Context, user string, password string, tab string) (*http.Response, error) {
+	err := client.Login(ctx, user, password)
 	if err != nil {
+		return nil, err
+	}
+	resp, err := client.overview(ctx)
+	if err != nil || tab == "" {
 		return resp, err
 	}
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return resp, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
 
-	return resp, err
+	return client.clickTab(ctx, doc, tab)
 }
@@ -1,19 +1,28 @@
+/*
+mqtt topics
+otraf/update (Will update all cards, or the cards of the user named in the message)
+otraf/<name> (Balance, passes and trips on the card)
+otraf/<name>/alert (Pass ending or low balance, active false when cleared)
+otraf/<name>/spend (Trips and SEK spent per month this year, see util.OtrafSpend)
+otraf/<name>/status (Result of the last update, see util.JobStatus)
+*/
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"math"
 	"os"
-	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/andersbetner/homeautomation/otraf"
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,14 +31,38 @@ type user struct {
 	Name     string `json:"name"`
 	User     string `json:"user"`
 	Password string `json:"password"`
-	Tab      string `json:"tab"`
+	Tab      string `json:"tab"` // Card nickname, users with the same login share it
+	// PassDays alerts when the pass ends within this many days, 0 is off
+	PassDays int `json:"passdays"`
+	// LowBalance alerts when the stored value is below this many SEK, 0 is off
+	LowBalance int `json:"lowbalance"`
+	// Notify is where alerts for the user are sent besides mqtt
+	Notify []util.NotifierConfig `json:"notify"`
+}
+
+// alert is published to otraf/<name>/alert when a condition is raised
+// or cleared
+type alert struct {
+	Name      string    `json:"name"`
+	Alert     string    `json:"alert"` // pass_ending or low_balance
+	Active    bool      `json:"active"`
+	CardEnd   time.Time `json:"cardend"`
+	Amount    int       `json:"amount"`
+	Threshold int       `json:"threshold"` // Days or SEK
+	Time      time.Time `json:"time"`
 }
 
 var (
-	mqttHost          string
-	agent             *ag.Agent
-	updateInterval    int
+	daemon            = util.NewDaemon("otraf")
 	users             []user
+	clientFlags       util.ClientFlags
+	credentialFlags   util.CredentialFlags
+	stateDir          string
+	historyDir        string
+	histories         = make(map[string]*otraf.TransactionLog) // By topic
+	historiesMu       sync.Mutex
+	alerts            *util.SentLog                     // Active alerts, kept in --statedir
+	notifiers         = make(map[string]util.Notifiers) // By topic
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_sensor_updates_total",
@@ -55,122 +88,398 @@ var (
 			Help: "Timestamp when monthly och day pass ends 0 if no pass",
 		}, []string{"type", "topic"},
 	)
+	promOtrafProductEnd = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_otraf_product_end",
+			Help: "Timestamp when a product on the card ends 0 if it doesn't",
+		}, []string{"product", "type", "n", "topic"},
+	)
+	promOtrafProductRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_otraf_product_remaining",
+			Help: "Trips or SEK left on a product on the card",
+		}, []string{"product", "type", "n", "topic"},
+	)
+	promOtrafSpent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_otraf_spent",
+			Help: "SEK spent on trips and products this year or month",
+		}, []string{"period", "topic"},
+	)
+	promOtrafTrips = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ab_otraf_trips",
+			Help: "Trips this year or month",
+		}, []string{"period", "topic"},
+	)
+	// Product labels set last run by topic, deleted when the product is gone
+	productLabels   = make(map[string][]prometheus.Labels)
+	productLabelsMu sync.Mutex
 )
 
-func update() {
-	for _, user := range users {
-		var err error
-		var topic string
-		if user.Tab == "" {
-			topic = strings.ToLower(user.Name)
-		} else {
-			topic = strings.ToLower(user.Tab)
+// setProductMetrics sets the product gauges for topic
+func setProductMetrics(topic string, o *otraf.Otraf) {
+	productLabelsMu.Lock()
+	defer productLabelsMu.Unlock()
+	for _, labels := range productLabels[topic] {
+		promOtrafProductEnd.Delete(labels)
+		promOtrafProductRemaining.Delete(labels)
+	}
+	var set []prometheus.Labels
+	for i, p := range o.Products {
+		labels := prometheus.Labels{"product": p.Name, "type": p.Type, "n": strconv.Itoa(i), "topic": topic}
+		end := float64(0)
+		if !p.End.IsZero() {
+			end = float64(p.End.Unix())
+		}
+		promOtrafProductEnd.With(labels).Set(end)
+		switch p.Type {
+		case otraf.Trips:
+			promOtrafProductRemaining.With(labels).Set(float64(p.Trips))
+		case otraf.Value:
+			promOtrafProductRemaining.With(labels).Set(float64(p.Value))
 		}
+		set = append(set, labels)
+	}
+	productLabels[topic] = set
+}
 
-		o := otraf.New(user.Name)
-		resp, err := otraf.GetHTML(user.User, user.Password, user.Tab)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err,
-				"type":  "otraf",
-				"topic": topic}).Error("Error getting html")
-			continue
+// history returns the transaction log for topic, opened on first use
+func history(topic string) (*otraf.TransactionLog, error) {
+	historiesMu.Lock()
+	defer historiesMu.Unlock()
+	if h, ok := histories[topic]; ok {
+		return h, nil
+	}
+	h, err := otraf.OpenTransactionLog(path.Join(historyDir, topic+"-transactions.jsonl"))
+	if err != nil {
+		return h, err
+	}
+	histories[topic] = h
+
+	return h, nil
+}
+
+// updateHistory fetches the transactions on card since the last update
+// and publishes the spend this year. Cards scraped from html have no
+// number and no history.
+func updateHistory(ctx context.Context, c *otraf.Client, u user, topic string, card otraf.Card) {
+	if historyDir == "" || card.Number == "" {
+		return
+	}
+	h, err := history(topic)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error open history")
+		return
+	}
+	transactions, err := c.Transactions(ctx, card.Number, h.Last())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"kind":  util.ErrorKind(err),
+			"topic": topic}).Error("Error getting transactions")
+		return
+	}
+	added, err := h.Add(transactions)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error update history")
+		return
+	}
+	log.WithFields(log.Fields{"transactions": len(added),
+		"topic": topic}).Debug("History")
+	now := time.Now()
+	spend := util.OtrafSpend{}
+	spend.Name = u.Name
+	spend.Year = now.Year()
+	for i, m := range h.Months(spend.Year) {
+		spend.Months[i] = util.OtrafMonth(m)
+		spend.Spent += m.Spent
+		spend.Trips += m.Trips
+	}
+	spend.Updated = now
+	month := spend.Months[now.Month()-1]
+	promOtrafSpent.WithLabelValues("year", topic).Set(float64(spend.Spent))
+	promOtrafSpent.WithLabelValues("month", topic).Set(float64(month.Spent))
+	promOtrafTrips.WithLabelValues("year", topic).Set(float64(spend.Trips))
+	promOtrafTrips.WithLabelValues("month", topic).Set(float64(month.Trips))
+	out, err := json.Marshal(spend)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error marshal json")
+		return
+	}
+	err = daemon.Publish("otraf/"+topic+"/spend", true, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error publish spend")
+	}
+}
+
+// topic returns the mqtt topic for the card of u
+func (u user) topic() string {
+	if u.Tab == "" {
+		return strings.ToLower(u.Name)
+	}
+
+	return strings.ToLower(u.Tab)
+}
+
+// login is the users sharing a login, their cards are fetched together
+type login struct {
+	user     string
+	password string
+	users    []user
+}
+
+// cardUsers returns the user for every card. A user gets the card with
+// the nickname in tab, without tab the card with its name or else the
+// first card. Cards nobody is configured for get a user named as the
+// nickname.
+func (l *login) cardUsers(cards []otraf.Card) []user {
+	ret := make([]user, len(cards))
+	found := make([]bool, len(cards))
+	taken := make(map[int]bool) // By index in l.users
+	for i, card := range cards {
+		for j, u := range l.users {
+			if taken[j] {
+				continue
+			}
+			if (u.Tab != "" && strings.EqualFold(u.Tab, card.Nickname)) ||
+				(u.Tab == "" && strings.EqualFold(u.Name, card.Nickname)) {
+				ret[i] = u
+				found[i] = true
+				taken[j] = true
+				break
+			}
+		}
+	}
+	for j, u := range l.users {
+		if !taken[j] && u.Tab == "" && len(cards) > 0 && !found[0] {
+			ret[0] = u
+			found[0] = true
+			taken[j] = true
 		}
-		o, err = otraf.Parse(resp, o)
+	}
+	for i, card := range cards {
+		if !found[i] {
+			ret[i] = user{Name: card.Nickname}
+		}
+	}
+
+	return ret
+}
+
+// daysLeft returns the days from today to t
+func daysLeft(t time.Time, now time.Time) int {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, now.Location())
+
+	return int(math.Round(day.Sub(today).Hours() / 24))
+}
+
+// checkAlerts raises or clears the alerts for the card of u
+func checkAlerts(ctx context.Context, u user, topic string, o *otraf.Otraf) {
+	now := time.Now()
+	if u.PassDays > 0 {
+		active := !o.CardEnd.IsZero() && daysLeft(o.CardEnd, now) <= u.PassDays
+		msg := fmt.Sprintf("Busskortet för %s gäller till %s", u.Name, o.CardEnd.Format("2006-01-02"))
+		setAlert(ctx, u, topic, "pass_ending", active, u.PassDays, o, msg)
+	}
+	if u.LowBalance > 0 {
+		active := o.Amount < u.LowBalance
+		msg := fmt.Sprintf("Busskortet för %s har %d kr kvar", u.Name, o.Amount)
+		setAlert(ctx, u, topic, "low_balance", active, u.LowBalance, o, msg)
+	}
+}
+
+// setAlert publishes and notifies an alert the first time it's active
+// and publishes it again when it has cleared, eg after a top up. The
+// alert is saved as sent once delivered, a failure is tried again next
+// run.
+func setAlert(ctx context.Context, u user, topic string, name string, active bool, threshold int, o *otraf.Otraf, msg string) {
+	key := name + " " + topic
+	if active == alerts.Sent(key) {
+		return
+	}
+	a := alert{}
+	a.Name = u.Name
+	a.Alert = name
+	a.Active = active
+	a.CardEnd = o.CardEnd
+	a.Amount = o.Amount
+	a.Threshold = threshold
+	a.Time = time.Now()
+	log.WithFields(log.Fields{"alert": name,
+		"active": active,
+		"topic":  topic}).Info("Alert")
+	out, err := json.Marshal(a)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error marshal json")
+		return
+	}
+	err = daemon.Publish("otraf/"+topic+"/alert", false, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error publish alert")
+		return
+	}
+	if active {
+		n := util.Notification{}
+		n.Name = u.Name
+		n.Type = name
+		n.Subject = "Busskort: " + u.Name
+		n.Message = msg
+		n.Data = a
+		n.Time = a.Time
+		err = notifiers[topic].Notify(ctx, n)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "otraf",
-				"topic": topic}).Error("Error parsing json")
-			continue
+				"topic": topic}).Error("Error notify alert")
+			return
 		}
-		out, err := json.Marshal(o)
+		err = alerts.Add(key, a.Time)
+	} else {
+		_, err = alerts.Remove(key)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"type":  "otraf",
+			"topic": topic}).Error("Error save alerts")
+	}
+}
+
+// update returns a job that publishes every card linked to the login
+func update(l *login) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		jobTopic := l.users[0].topic()
+		c, err := otraf.NewClient(clientFlags.Options()...)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "otraf",
-				"topic": topic}).Error("Error marshal json")
-			continue
+				"topic": jobTopic}).Error("Error create client")
+			return err
 		}
-		err = agent.Publish("otraf/"+topic, true, string(out))
+		cards, err := c.Cards(ctx, l.user, l.password)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err,
 				"type":  "otraf",
-				"topic": topic}).Error("Error publish otraf")
-			continue
+				"kind":  util.ErrorKind(err),
+				"topic": jobTopic}).Error("Error getting cards")
+			return err
+		}
+		for i, u := range l.cardUsers(cards) {
+			topic := u.topic()
+			if topic == "" {
+				log.WithFields(log.Fields{"type": "otraf",
+					"topic": jobTopic}).Warn("Card without nickname, add a user with a tab")
+				continue
+			}
+			o := cards[i].Otraf(u.Name)
+			out, err := json.Marshal(o)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err,
+					"type":  "otraf",
+					"topic": topic}).Error("Error marshal json")
+				return err
+			}
+			err = daemon.Publish("otraf/"+topic, true, string(out))
+			if err != nil {
+				log.WithFields(log.Fields{"error": err,
+					"type":  "otraf",
+					"topic": topic}).Error("Error publish otraf")
+				return err
+			}
+			promUpdateCounter.WithLabelValues("200", "otraf", topic).Inc()
+			promOtrafAmount.WithLabelValues("otraf", topic).Set(float64(o.Amount))
+			promOtrafCardStart.WithLabelValues("otraf", topic).Set(float64(o.CardStart.Unix()))
+			promOtrafCardEnd.WithLabelValues("otraf", topic).Set(float64(o.CardEnd.Unix()))
+			setProductMetrics(topic, o)
+			checkAlerts(ctx, u, topic, o)
+			updateHistory(ctx, c, u, topic, cards[i])
+			log.WithFields(log.Fields{
+				"topic": topic}).Debug("Publish otraf")
 		}
-		promUpdateCounter.WithLabelValues("200", "otraf", topic).Inc()
-		promOtrafAmount.WithLabelValues("otraf", topic).Set(float64(o.Amount))
-		promOtrafCardStart.WithLabelValues("otraf", topic).Set(float64(o.CardStart.Unix()))
-		promOtrafCardEnd.WithLabelValues("otraf", topic).Set(float64(o.CardEnd.Unix()))
-		log.WithFields(log.Fields{
-			"topic": topic}).Debug("Publish otraf")
 
+		return nil
 	}
 }
+
 func init() {
-	log.SetLevel(log.DebugLevel)
 	prometheus.MustRegister(promUpdateCounter)
 	prometheus.MustRegister(promOtrafAmount)
 	prometheus.MustRegister(promOtrafCardStart)
 	prometheus.MustRegister(promOtrafCardEnd)
-	var configFile string
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
-	flag.StringVar(&configFile, "config", "", "full path to configfile eg --config=/etc/users.json ")
-	flag.IntVar(&updateInterval, "updateinterval", 30, "integer > 0")
-	flag.Parse()
-	exit := false
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
-	}
-	if configFile == "" {
-		os.Stderr.WriteString("--config missing eg --config=/etc/users.json\n")
-		exit = true
-	}
-
-	if exit {
-		os.Exit(1)
-	}
+	prometheus.MustRegister(promOtrafProductEnd)
+	prometheus.MustRegister(promOtrafProductRemaining)
+	prometheus.MustRegister(promOtrafSpent)
+	prometheus.MustRegister(promOtrafTrips)
 
-	jsonStr, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("Can't read %s\n", configFile))
-		os.Stderr.WriteString(err.Error() + "\n")
+	daemon.Scheduled = true
+	daemon.ConfigExample = "/etc/users.json"
+	flag.StringVar(&stateDir, "statedir", "", "keep active alerts in this dir between restarts eg --statedir=/var/lib/otraf")
+	flag.StringVar(&historyDir, "historydir", "", "keep the card transactions in this dir eg --historydir=/var/lib/otraf")
+	clientFlags.Register()
+	credentialFlags.Register()
+	if daemon.ParseFlags() {
 		os.Exit(1)
 	}
-	err = json.Unmarshal([]byte(jsonStr), &users)
+	daemon.LoadConfig(&users)
+	alertFile := ""
+	if stateDir != "" {
+		alertFile = path.Join(stateDir, "alerts.json")
+	}
+	var err error
+	alerts, err = util.OpenSentLog(alertFile)
 	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("Can't unmarshal json in %s\n", configFile))
-		os.Stderr.WriteString(err.Error() + "\n")
+		os.Stderr.WriteString("Can't load alerts: " + err.Error() + "\n")
 		os.Exit(1)
 	}
-
-}
-func main() {
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("prometheus", ":9100", prometheusMux)
-	host, err := os.Hostname()
-	if err != nil {
-		host = "opac"
+	for i, u := range users {
+		// Without a password in users.json, eg OTRAF_ANDERS_PASSWORD
+		c, err := credentialFlags.Lookup("otraf/"+u.topic(), util.Credentials{User: u.User, Password: u.Password})
+		if err != nil {
+			os.Stderr.WriteString("Credentials for " + u.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		users[i].User = c.User
+		users[i].Password = c.Password
+		notifiers[u.topic()], err = util.NewNotifiers(u.Notify)
+		if err != nil {
+			os.Stderr.WriteString("Notify for " + u.Name + ": " + err.Error() + "\n")
+			os.Exit(1)
+		}
 	}
-	agent = ag.NewAgent(mqttHost, "opac-"+host)
-	err = agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
+	// One login gives every card linked to it
+	var logins []*login
+	for _, u := range users {
+		var l *login
+		for _, existing := range logins {
+			if existing.user == u.User && existing.password == u.Password {
+				l = existing
+			}
+		}
+		if l == nil {
+			l = &login{user: u.User, password: u.Password}
+			logins = append(logins, l)
+		}
+		l.users = append(l.users, u)
 	}
-	// agent.Subscribe("opac/update", updateHandler)
-	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
-		log.Info("Shutting down opac")
-		time.Sleep(2 * time.Second)
-		os.Exit(0)
-	}()
-
-	for !agent.IsTerminated() {
-		update()
-		time.Sleep(time.Duration(updateInterval) * time.Minute)
+	for _, l := range logins {
+		daemon.Schedule(&util.Job{Name: strings.ToLower(l.users[0].Name), Run: update(l)})
 	}
+}
 
+func main() {
+	daemon.Subscribe("otraf/update", daemon.Scheduler.TriggerHandler())
+	daemon.Run()
 }
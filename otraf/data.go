@@ -1,8 +1,30 @@
 package otraf
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
-// Otraf holds bus card data
+// Product types
+const (
+	PeriodPass = "period" // Valid from Start to End
+	Trips      = "trips"  // Remaining trips, eg a punch card
+	Value      = "value"  // Stored value in SEK
+)
+
+// Product is a pass, trips or stored value on a card
+type Product struct {
+	Type  string    `json:"type"` // PeriodPass, Trips or Value
+	Name  string    `json:"name"` // As on the card eg 30-dagarsbiljett
+	Zone  string    `json:"zone"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`   // Zero if it doesn't expire
+	Trips int       `json:"trips"` // Remaining trips
+	Value int       `json:"value"` // Remaining SEK
+}
+
+// Otraf holds bus card data. CardStart, CardEnd and Amount sum up
+// Products, see SetProducts.
 type Otraf struct {
 	Name        string    `json:"name"`
 	CardStart   time.Time `json:"cardstart"`
@@ -10,6 +32,7 @@ type Otraf struct {
 	Amount      int       `json:"amount"`
 	Updated     time.Time `json:"updated"`
 	CardUpdated time.Time `json:"card_updated"`
+	Products    []Product `json:"products"`
 }
 
 // New returns a new Opac
@@ -20,3 +43,39 @@ func New(name string) *Otraf {
 
 	return o
 }
+
+// SetProducts sets the products and sums them up. Amount is the stored
+// value and CardStart to CardEnd the time covered by the first pass and
+// the passes queued after it.
+func (o *Otraf) SetProducts(products []Product) {
+	o.Products = products
+	o.Amount = 0
+	o.CardStart = time.Time{}
+	o.CardEnd = time.Time{}
+	var passes []Product
+	for _, p := range products {
+		switch p.Type {
+		case Value:
+			o.Amount += p.Value
+		case PeriodPass:
+			passes = append(passes, p)
+		}
+	}
+	sort.Slice(passes, func(i, j int) bool {
+		return passes[i].Start.Before(passes[j].Start)
+	})
+	for i, p := range passes {
+		if i == 0 {
+			o.CardStart = p.Start
+			o.CardEnd = p.End
+			continue
+		}
+		// A pass starting the day after the last one ends is queued
+		if p.Start.After(o.CardEnd.AddDate(0, 0, 1)) {
+			break
+		}
+		if p.End.After(o.CardEnd) {
+			o.CardEnd = p.End
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andersbetner/homeautomation/util"
 )
 
 func parseDateTime(str string) (time.Time, error) {
@@ -29,51 +31,98 @@ func parseDate(str string) (time.Time, error) {
 	return ret, nil
 }
 
-// Parse parses a page from otraf
+var (
+	// 30-dagarsbiljett Zon 1 Från 2017-01-23 Till 2017-02-22
+	periodRex = regexp.MustCompile(`^(.*?)\s*Från (\d{4}-\d\d-\d\d).*? Till (\d{4}-\d\d-\d\d)`)
+	// Reskassa 120 kr
+	valueRex = regexp.MustCompile(`^(.*?)\s*(\d+) kr`)
+	// Klippkort 8 resor kvar
+	tripsRex = regexp.MustCompile(`^(.*?)\s*(\d+) resor`)
+	zoneRex  = regexp.MustCompile(`\s*Zon:? (\S+)`)
+)
+
+// parseProduct parses a line in the card element, false if it isn't a
+// product
+func parseProduct(line string) (Product, bool, error) {
+	p := Product{}
+	if m := zoneRex.FindStringSubmatch(line); m != nil {
+		p.Zone = m[1]
+		line = zoneRex.ReplaceAllString(line, "")
+	}
+	var err error
+	if m := periodRex.FindStringSubmatch(line); m != nil {
+		p.Type = PeriodPass
+		p.Name = m[1]
+		if p.Start, err = parseDate(m[2]); err != nil {
+			return p, false, util.WrapError(util.ErrLayoutChanged, err)
+		}
+		if p.End, err = parseDate(m[3]); err != nil {
+			return p, false, util.WrapError(util.ErrLayoutChanged, err)
+		}
+		return p, true, nil
+	}
+	if m := tripsRex.FindStringSubmatch(line); m != nil {
+		p.Type = Trips
+		p.Name = m[1]
+		p.Trips, err = strconv.Atoi(m[2])
+		return p, err == nil, nil
+	}
+	if m := valueRex.FindStringSubmatch(line); m != nil {
+		p.Type = Value
+		p.Name = m[1]
+		p.Value, err = strconv.Atoi(m[2])
+		return p, err == nil, nil
+	}
+
+	return p, false, nil
+}
+
+// Parse parses a page from otraf, a whole page or the partial response
+// to a tab click
 func Parse(resp *http.Response, o *Otraf) (*Otraf, error) {
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	doc, err := responseDocument(resp)
 	if err != nil {
 		return o, err
 	}
-	page := doc.Text()
 
-	// Check cash on card
-	cash := 0
-	cashRex := regexp.MustCompile(`(\d+) kr`)
-	match := cashRex.FindAllStringSubmatch(page, 2)
-	if match != nil {
-		for _, m := range match {
-			amount, err := strconv.Atoi(m[1])
-			if err == nil {
-				cash += amount
-			}
-		}
-	}
-	o.Amount = cash
+	return parseDocument(doc, o)
+}
 
-	// Check monthly card
-	// Fr&#229;n  2017-01-23 Till 2017-02-22
-	cardRex := regexp.MustCompile(`Från (\d{4}-\d\d-\d\d).*? Till (\d{4}-\d\d-\d\d)`)
-	match = cardRex.FindAllStringSubmatch(page, 1)
+func parseDocument(doc *goquery.Document, o *Otraf) (*Otraf, error) {
+	var err error
+	page := doc.Text()
+	if doc.Find("input[type=\"password\"]").Length() > 0 {
+		return o, util.Errorf(util.ErrAuthFailed, "Got the login form instead of the card")
+	}
+	if !strings.Contains(page, "Senast uppdaterat") {
+		return o, util.Errorf(util.ErrLayoutChanged, "Can't find text Senast uppdaterat on page")
+	}
 
-	if match != nil {
-		o.CardStart, err = parseDate(match[0][1])
+	// Only the card has products, prices and notices elsewhere on the
+	// page would look like value
+	card := doc.Find(".card")
+	if card.Length() == 0 {
+		return o, util.Errorf(util.ErrLayoutChanged, "Can't find the card on page")
+	}
+	var products []Product
+	for _, line := range strings.Split(card.Text(), "\n") {
+		product, ok, err := parseProduct(strings.TrimSpace(line))
 		if err != nil {
 			return o, err
 		}
-		o.CardEnd, err = parseDate(match[0][2])
-		if err != nil {
-			return o, err
+		if ok {
+			products = append(products, product)
 		}
 	}
+	o.SetProducts(products)
 
 	// Get card updated
 	updatedRex := regexp.MustCompile(`\(Senast uppdaterat.*(\d{4}.*?)\)`)
-	match = updatedRex.FindAllStringSubmatch(page, 1)
+	match := updatedRex.FindAllStringSubmatch(page, 1)
 	if match != nil {
 		o.CardUpdated, err = parseDateTime(match[0][1])
 		if err != nil {
-			return o, err
+			return o, util.WrapError(util.ErrLayoutChanged, err)
 		}
 	}
 	return o, nil
@@ -0,0 +1,79 @@
+package otraf
+
+import (
+	"context"
+	"flag"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected json in testdata")
+
+// TestParsers replays the fixtures in testdata through the client and
+// the parsers. The fixtures are synthetic, record real ones with
+// fixtures record --site=otraf
+func TestParsers(t *testing.T) {
+	// Parsers use local time, keep the expected json stable
+	time.Local = time.UTC
+	tests := []struct {
+		name     string
+		expected string
+		run      func(ctx context.Context, c *Client) (interface{}, error)
+	}{
+		{"first card", "expected.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			resp, err := c.GetHTML(ctx, "XXX", "XXX", "")
+			if err != nil {
+				return nil, err
+			}
+			o := New("Anders")
+			o.Updated = time.Time{}
+
+			return Parse(resp, o)
+		}},
+		{"tab", "expected_tab.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			resp, err := c.GetHTML(ctx, "XXX", "XXX", "Lowe")
+			if err != nil {
+				return nil, err
+			}
+			o := New("Lowe")
+			o.Updated = time.Time{}
+
+			return Parse(resp, o)
+		}},
+		{"cards", "expected_cards.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			return c.Cards(ctx, "XXX", "XXX")
+		}},
+		{"cards html", "expected_cards_html.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			if err := c.Login(ctx, "XXX", "XXX"); err != nil {
+				return nil, err
+			}
+
+			return c.HTMLCards(ctx)
+		}},
+		{"transactions", "expected_transactions.json", func(ctx context.Context, c *Client) (interface{}, error) {
+			if err := c.Login(ctx, "XXX", "XXX"); err != nil {
+				return nil, err
+			}
+
+			return c.Transactions(ctx, "XXX", time.Date(2020, 2, 1, 0, 0, 0, 0, time.Local))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(util.WithTransport(&util.ReplayTransport{Dir: "testdata"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.run(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = util.Golden(path.Join("testdata", tt.expected), got, *update); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package otraf
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andersbetner/homeautomation/util"
+)
+
+// Transaction types
+const (
+	Validation = "validation" // A trip, paid with a pass, trips or value
+	TopUp      = "topup"      // Value loaded on the card
+	Purchase   = "purchase"   // A pass or trips bought to the card
+)
+
+// Transaction is a validation, top-up or purchase on a card
+type Transaction struct {
+	Type    string    `json:"type"` // Validation, TopUp or Purchase
+	Time    time.Time `json:"time"`
+	Product string    `json:"product"` // Used or bought eg Reskassa
+	Line    string    `json:"line"`    // Empty unless a validation
+	Zone    string    `json:"zone"`
+	Amount  int       `json:"amount"` // SEK paid or loaded, 0 for a trip on a pass
+}
+
+// key identifies a transaction, the card history overlaps between fetches.
+// Two validations the same second on the same line have the same key, see
+// TransactionLog.Add.
+func (t Transaction) key() string {
+	return t.Time.Format(time.RFC3339) + " " + t.Type + " " + t.Line + " " + strconv.Itoa(t.Amount)
+}
+
+type apiTransaction struct {
+	TransactionType string  `json:"TransactionType"` // Validation, Load or Purchase
+	TransactionTime string  `json:"TransactionTime"`
+	ProductName     string  `json:"ProductName"`
+	Line            string  `json:"Line"`
+	Zone            string  `json:"Zone"`
+	Amount          float64 `json:"Amount"` // Negative when paid from the card
+}
+
+var transactionTypes = map[string]string{
+	"Validation": Validation,
+	"Load":       TopUp,
+	"Purchase":   Purchase,
+}
+
+// Transactions returns the transactions on the card with number made
+// from and after from, every transaction the card api has if from is
+// zero. Call Login first.
+func (client *Client) Transactions(ctx context.Context, number string, from time.Time) ([]Transaction, error) {
+	var transactions []Transaction
+	query := url.Values{}
+	query.Set("cardNumber", number)
+	if !from.IsZero() {
+		query.Set("fromDate", from.Format("2006-01-02"))
+	}
+	r, err := http.NewRequestWithContext(ctx, "GET", client.siteURL+"/ajax2/store/cardclient/gettransactions?"+query.Encode(), nil)
+	if err != nil {
+		return transactions, err
+	}
+	r.Header.Set("Accept", "application/json")
+	resp, err := client.do(r)
+	if err != nil {
+		return transactions, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return transactions, util.Errorf(util.ErrLayoutChanged, "Transaction api returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return transactions, util.WrapError(util.ErrUpstreamUnavailable, err)
+	}
+	var apiTransactions []apiTransaction
+	err = json.Unmarshal(body, &apiTransactions)
+	if err != nil {
+		return transactions, util.WrapError(util.ErrLayoutChanged, err)
+	}
+	for _, a := range apiTransactions {
+		t := Transaction{}
+		var ok bool
+		if t.Type, ok = transactionTypes[a.TransactionType]; !ok {
+			return transactions, util.Errorf(util.ErrLayoutChanged, "Unknown transaction type %s", a.TransactionType)
+		}
+		if t.Time, err = parseAPITime(a.TransactionTime); err != nil {
+			return transactions, err
+		}
+		if t.Time.Before(from) {
+			continue
+		}
+		t.Product = a.ProductName
+		t.Line = a.Line
+		t.Zone = a.Zone
+		t.Amount = int(math.Round(math.Abs(a.Amount)))
+		transactions = append(transactions, t)
+	}
+
+	return transactions, nil
+}
+
+// Month sums up the transactions in a month
+type Month struct {
+	Trips int `json:"trips"`
+	Spent int `json:"spent"` // SEK paid for trips, passes and trips bought
+	TopUp int `json:"topup"` // SEK loaded, spent when used for a trip
+}
+
+// TransactionLog is the transaction history of one card, fetched a bit
+// at a time. Transactions are appended to File as json lines.
+type TransactionLog struct {
+	File         string
+	mu           sync.Mutex
+	transactions []Transaction
+	count        map[string]int // By key
+}
+
+// OpenTransactionLog loads the transactions in file, a missing file gives
+// an empty log. A last line cut short by a crash is dropped, see
+// util.ReadJSONLines.
+func OpenTransactionLog(file string) (*TransactionLog, error) {
+	l := &TransactionLog{}
+	l.File = file
+	l.count = make(map[string]int)
+	err := util.ReadJSONLines(file, func(line []byte) error {
+		t := Transaction{}
+		if err := json.Unmarshal(line, &t); err != nil {
+			return err
+		}
+		l.transactions = append(l.transactions, t)
+		l.count[t.key()]++
+
+		return nil
+	})
+
+	return l, err
+}
+
+// Last returns the time of the latest transaction, zero if none
+func (l *TransactionLog) Last() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var last time.Time
+	for _, t := range l.transactions {
+		if t.Time.After(last) {
+			last = t.Time
+		}
+	}
+
+	return last
+}
+
+// Add saves and returns the transactions that aren't in the log. A key
+// that is in transactions more times than in the log is a new trip.
+func (l *TransactionLog) Add(transactions []Transaction) ([]Transaction, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var added []Transaction
+	seen := make(map[string]int)
+	for _, t := range transactions {
+		seen[t.key()]++
+		if seen[t.key()] > l.count[t.key()] {
+			added = append(added, t)
+		}
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	f, err := os.OpenFile(l.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for _, t := range added {
+		line, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+		// Marked once written, a failed write is tried again next poll
+		l.count[t.key()]++
+		l.transactions = append(l.transactions, t)
+	}
+
+	return added, f.Close()
+}
+
+// Months returns the trips, spend and top-ups per month in year. A top-up
+// isn't spend, the trips paid with the value are.
+func (l *TransactionLog) Months(year int) (months [12]Month) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range l.transactions {
+		if t.Time.Year() != year {
+			continue
+		}
+		m := &months[t.Time.Month()-1]
+		switch t.Type {
+		case Validation:
+			m.Trips++
+			m.Spent += t.Amount
+		case Purchase:
+			m.Spent += t.Amount
+		case TopUp:
+			m.TopUp += t.Amount
+		}
+	}
+
+	return months
+}
@@ -5,17 +5,14 @@ package main
 
 import (
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 // senseData holds info posted from the sen.se API
@@ -29,8 +26,7 @@ type senseData struct {
 
 var (
 	nodeUIDMap        map[string]string
-	mqttHost          string
-	agent             *ag.Agent
+	daemon            = util.NewDaemon("sense")
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_sensor_updates_total",
@@ -73,7 +69,7 @@ func senseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var temperature = float64(indata.Data.CentidegreeCelsius) / 100
-	agent.Publish("temperature/"+sensor, true, fmt.Sprintf("%v", temperature))
+	daemon.Publish("temperature/"+sensor, true, fmt.Sprintf("%v", temperature))
 	promUpdateCounter.WithLabelValues("200", "temperature", sensor).Inc()
 	promTemperature.WithLabelValues(sensor).Set(temperature)
 	log.WithFields(log.Fields{"topic": sensor, "value": temperature}).Debug("Published")
@@ -85,62 +81,20 @@ func init() {
 	prometheus.MustRegister(promUpdateCounter)
 	prometheus.MustRegister(promTemperature)
 
-	var configFile string
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
-	flag.StringVar(&configFile, "config", "", "full path to configfile eg --config=/etc/id_map.json ")
-	flag.Parse()
-	exit := false
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
-	}
-	if configFile == "" {
-		os.Stderr.WriteString("--config missing eg --config=/etc/id_map.json\n")
-		exit = true
-	}
-
-	if exit {
+	daemon.ConfigExample = "/etc/id_map.json"
+	if daemon.ParseFlags() {
 		os.Exit(1)
 	}
-
 	nodeUIDMap = make(map[string]string)
-	jsonStr, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("Can't read %s\n", configFile))
-		os.Stderr.WriteString(err.Error() + "\n")
-		os.Exit(1)
-	}
-	err = json.Unmarshal([]byte(jsonStr), &nodeUIDMap)
-	if err != nil {
-		os.Stderr.WriteString("Can't unmarshal id_map.json")
-		os.Stderr.WriteString(err.Error() + "\n")
-		os.Exit(1)
-	}
-
+	daemon.LoadConfig(&nodeUIDMap)
 }
 
 func main() {
-	log.SetLevel(log.DebugLevel)
-
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("Prometheus", ":9100", prometheusMux)
-
 	senseMux := http.NewServeMux()
 	senseMux.HandleFunc("/", senseHandler)
-	go util.Webserver("sense", ":8080", senseMux)
-
-	agent = ag.NewAgent(mqttHost, "sense")
-	err := agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
-	}
-
-	for !agent.IsTerminated() {
-		time.Sleep(time.Second * 2)
-	}
+	daemon.Serve("sense", ":8080", senseMux)
 
+	daemon.Run()
 }
 
 //{
@@ -1,24 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"net/http"
 	"os"
-	"os/signal"
 	"regexp"
 	"time"
 
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 var (
-	mqttHost          string
-	agent             *ag.Agent
+	daemon            = util.NewDaemon("telldus")
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_agent_updates_total",
@@ -60,19 +57,32 @@ func topic(data []string) (string, string) {
 
 	return "", ""
 }
-func listener() {
+func listener(ctx context.Context) {
 
-	for {
+	for ctx.Err() == nil {
 		log.Debug("Connect telldus unix socket")
 
-		telldusSocket, err := net.Dial("unix", "/tmp/TelldusEvents")
+		var dialer net.Dialer
+		telldusSocket, err := dialer.DialContext(ctx, "unix", "/tmp/TelldusEvents")
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Connect to telldus unix socket")
 			promErrorCounter.WithLabelValues("telldus", "connect").Inc()
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
 			continue
 		}
-		defer telldusSocket.Close()
+		// Unblock Read on shutdown
+		closed := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-closed:
+			}
+			telldusSocket.Close()
+		}()
 		buf := make([]byte, 1024)
 		re := regexp.MustCompile(`TDRawDeviceEvent.*class:command;protocol:arctech;model:selflearning;house:(\d+);unit:(\d+);group:(\d+);method:(\w+)`)
 		for {
@@ -81,6 +91,7 @@ func listener() {
 				if err != nil {
 					promErrorCounter.WithLabelValues("telldus", "read").Inc()
 					log.WithField("error", err).Error("Read from socket")
+					close(closed)
 					break
 				}
 
@@ -89,7 +100,7 @@ func listener() {
 				if res != nil {
 					topic, data := topic(res)
 					if topic != "" {
-						err := agent.Publish(topic, true, data)
+						err := daemon.Publish(topic, true, data)
 						if err != nil {
 							promErrorCounter.WithLabelValues("telldus", "publish").Inc()
 							log.WithFields(log.Fields{"error": err,
@@ -104,13 +115,16 @@ func listener() {
 				}
 			}
 		}
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
 	}
 
 }
 
 func init() {
-	log.SetLevel(log.DebugLevel)
 	prometheus.MustRegister(promUpdateCounter)
 	viper.SetConfigName("telldusagent")
 	viper.AddConfigPath("/etc/telldus")
@@ -118,9 +132,9 @@ func init() {
 	viper.ReadInConfig()
 
 	exit := false
-	mqttHost = viper.GetString("mqtthost")
+	daemon.MQTTHost = viper.GetString("mqtthost")
 
-	if mqttHost == "" {
+	if daemon.MQTTHost == "" {
 		log.Error("mqtthost missing in config")
 		exit = true
 	}
@@ -131,27 +145,6 @@ func init() {
 }
 
 func main() {
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("prometheus", ":9100", prometheusMux)
-
-	agent = ag.NewAgent(mqttHost, "telldus")
-	err := agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
-	}
-	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
-		log.Debug("Shutting down telldus")
-		time.Sleep(2 * time.Second)
-		os.Exit(0)
-	}()
-	go listener()
-	for !agent.IsTerminated() {
-
-		time.Sleep(time.Duration(1) * time.Minute)
-	}
+	go listener(daemon.Context())
+	daemon.Run()
 }
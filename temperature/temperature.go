@@ -1,28 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/andersbetner/homeautomation/util"
-	ag "github.com/andersbetner/mqttagent"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	mqttHost          string
-	agent             *ag.Agent
+	daemon            = util.NewDaemon("temperature")
 	temperatureURL    string
-	updateInterval    int // minutes default=15
 	promUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ab_sensor_updates_total",
@@ -39,18 +36,18 @@ var (
 )
 
 // update gets the outdoor temperature from temperatur.nu
-func update() {
+func update(ctx context.Context) error {
 	client := &http.Client{
 		CheckRedirect: nil,
 		Timeout:       time.Second * 10,
 	}
-	request, _ := http.NewRequest("GET", temperatureURL, nil)
+	request, _ := http.NewRequestWithContext(ctx, "GET", temperatureURL, nil)
 	resp, err := client.Do(request)
 	if err != nil {
 		promUpdateCounter.WithLabelValues("500", "temperature", "request").Inc()
 		log.WithField("error", err).Error("Error initiating request")
 
-		return
+		return err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
@@ -58,42 +55,39 @@ func update() {
 		promUpdateCounter.WithLabelValues("500", "temperature", "parse").Inc()
 		log.WithField("error", err).Error("Error getting request body")
 
-		return
+		return err
 	}
 	temperature, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
 	if err != nil {
 		promUpdateCounter.WithLabelValues("500", "temperature", "parse").Inc()
 		log.WithField("error", string(body)).Error("Error malformed float value", string(body))
 
-		return
+		return err
 	}
-	err = agent.Publish("temperature/outdoor/state", true, fmt.Sprintf("%v", temperature))
+	err = daemon.Publish("temperature/outdoor/state", true, fmt.Sprintf("%v", temperature))
 	if err != nil {
 		promUpdateCounter.WithLabelValues("500", "temperature", "publish").Inc()
 		log.WithField("error", err).Error("Error publishing mqtt")
 
-		return
+		return err
 	}
 
 	promUpdateCounter.WithLabelValues("200", "temperature", "outdoor").Inc()
 	promTemperature.WithLabelValues("outdoor").Set(temperature)
 	log.WithField("temperature", temperature).Debug("Outdoor temp")
+
+	return nil
 }
 
 func init() {
-	log.SetLevel(log.DebugLevel)
 	prometheus.MustRegister(promUpdateCounter)
 	prometheus.MustRegister(promTemperature)
 
-	exit := false
-	flag.StringVar(&mqttHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
+	daemon.Schedule(&util.Job{Name: "outdoor", Run: update})
+	daemon.UpdateInterval = 15
 	flag.StringVar(&temperatureURL, "url", "", "url for temperature server eg http://example.com/temp.txt")
-	flag.IntVar(&updateInterval, "interval", 15, "integer > 0")
-	flag.Parse()
-	if mqttHost == "" {
-		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
-		exit = true
-	}
+	flag.IntVar(&daemon.UpdateInterval, "interval", daemon.UpdateInterval, "deprecated, use --updateinterval")
+	exit := daemon.ParseFlags()
 
 	if temperatureURL == "" {
 		os.Stderr.WriteString("--url missig, eg --url=http://example.com/temp.txt\n")
@@ -112,29 +106,5 @@ func init() {
 }
 
 func main() {
-	log.SetLevel(log.DebugLevel)
-	prometheusMux := http.NewServeMux()
-	prometheusMux.Handle("/metrics", prometheus.Handler())
-	go util.Webserver("Prometheus", ":9100", prometheusMux)
-
-	agent = ag.NewAgent(mqttHost, "temperature")
-	err := agent.Connect()
-	if err != nil {
-		log.WithField("error", err).Error("Can't connect to mqtt server")
-		os.Exit(1)
-	}
-	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
-		log.Info("Shutting down temperature")
-		time.Sleep(2 * time.Second)
-		os.Exit(0)
-	}()
-
-	for !agent.IsTerminated() {
-		update()
-		time.Sleep(time.Duration(updateInterval) * time.Minute)
-	}
-
+	daemon.Run()
 }
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+type savedCookie struct {
+	URL    string       `json:"url"`
+	Cookie *http.Cookie `json:"cookie"`
+}
+
+// FileJar is a cookie jar that is saved to File on every change and
+// loaded when created, so sessions survive restarts
+type FileJar struct {
+	File    string
+	jar     *cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]savedCookie
+}
+
+// NewFileJar returns a FileJar with the cookies in file, a missing file
+// gives an empty jar
+func NewFileJar(file string) (*FileJar, error) {
+	j := &FileJar{}
+	j.File = file
+	j.cookies = make(map[string]savedCookie)
+	var err error
+	j.jar, err = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return j, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return j, err
+	}
+	var saved []savedCookie
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return j, err
+	}
+	for _, s := range saved {
+		u, err := url.Parse(s.URL)
+		if err != nil || s.Cookie == nil {
+			continue
+		}
+		j.set(u, s.Cookie)
+	}
+
+	return j, nil
+}
+
+func (j *FileJar) set(u *url.URL, cookie *http.Cookie) {
+	j.jar.SetCookies(u, []*http.Cookie{cookie})
+	key := u.Host + " " + cookie.Path + " " + cookie.Name
+	if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+		delete(j.cookies, key)
+		return
+	}
+	j.cookies[key] = savedCookie{u.String(), cookie}
+}
+
+// SetCookies implements http.CookieJar
+func (j *FileJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, cookie := range cookies {
+		j.set(u, cookie)
+	}
+	if err := j.save(); err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"file": j.File}).Warn("Can't save cookies")
+	}
+}
+
+// Cookies implements http.CookieJar
+func (j *FileJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *FileJar) save() error {
+	saved := make([]savedCookie, 0, len(j.cookies))
+	for _, s := range j.cookies {
+		saved = append(saved, s)
+	}
+	out, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(j.File, out, 0600)
+}
@@ -0,0 +1,228 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoCredentials is returned by a CredentialProvider without credentials
+// for the name
+var ErrNoCredentials = errors.New("No credentials")
+
+// Credentials is a login to a scraped site
+type Credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// CredentialProvider looks up credentials by name eg opac/anders or ica
+type CredentialProvider interface {
+	Credentials(name string) (Credentials, error)
+}
+
+// SecretDir reads the files user and password in Dir/name, eg a
+// Kubernetes secret with the keys user and password mounted there
+type SecretDir struct {
+	Dir string
+}
+
+// Credentials implements CredentialProvider, a missing user file gives an
+// empty user
+func (s SecretDir) Credentials(name string) (Credentials, error) {
+	c := Credentials{}
+	dir := path.Join(s.Dir, name)
+	password, err := ioutil.ReadFile(path.Join(dir, "password"))
+	if os.IsNotExist(err) {
+		return c, ErrNoCredentials
+	}
+	if err != nil {
+		return c, err
+	}
+	c.Password = strings.TrimRight(string(password), "\r\n")
+	user, err := ioutil.ReadFile(path.Join(dir, "user"))
+	if err != nil && !os.IsNotExist(err) {
+		return c, err
+	}
+	c.User = strings.TrimRight(string(user), "\r\n")
+
+	return c, nil
+}
+
+// EnvCredentials reads NAME_USER and NAME_PASSWORD, name upper cased with
+// every character but letters and digits as _, eg OPAC_ANDERS_PASSWORD
+type EnvCredentials struct{}
+
+// envName returns name as an environment variable prefix
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// Credentials implements CredentialProvider
+func (EnvCredentials) Credentials(name string) (Credentials, error) {
+	c := Credentials{}
+	prefix := envName(name)
+	password, ok := os.LookupEnv(prefix + "_PASSWORD")
+	if !ok {
+		return c, ErrNoCredentials
+	}
+	c.Password = password
+	c.User = os.Getenv(prefix + "_USER")
+
+	return c, nil
+}
+
+// EncryptedCredentials holds credentials by name from a json file
+// encrypted with age, made with the age tools
+//
+//	age-keygen -o /etc/homeautomation/key.txt
+//	age -r <public key> -o credentials.age credentials.json
+type EncryptedCredentials struct {
+	credentials map[string]Credentials
+}
+
+// OpenEncryptedCredentials decrypts file, binary or armored, with the age
+// identities in keyFile
+func OpenEncryptedCredentials(file string, keyFile string) (*EncryptedCredentials, error) {
+	keys, err := os.Open(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Close()
+	identities, err := age.ParseIdentities(keys)
+	if err != nil {
+		return nil, fmt.Errorf("Key in %s: %w", keyFile, err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+	var src io.Reader = in
+	if start, _ := in.Peek(len(armor.Header)); string(start) == armor.Header {
+		src = armor.NewReader(in)
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt %s: %w", file, err)
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt %s: %w", file, err)
+	}
+	e := &EncryptedCredentials{}
+	err = json.Unmarshal(plain, &e.credentials)
+
+	return e, err
+}
+
+// Credentials implements CredentialProvider
+func (e *EncryptedCredentials) Credentials(name string) (Credentials, error) {
+	c, ok := e.credentials[name]
+	if !ok {
+		return c, ErrNoCredentials
+	}
+
+	return c, nil
+}
+
+// CredentialChain asks every provider in order until one has credentials
+type CredentialChain []CredentialProvider
+
+// Credentials implements CredentialProvider
+func (l CredentialChain) Credentials(name string) (Credentials, error) {
+	for _, p := range l {
+		c, err := p.Credentials(name)
+		if !errors.Is(err, ErrNoCredentials) {
+			return c, err
+		}
+	}
+
+	return Credentials{}, fmt.Errorf("%w for %s", ErrNoCredentials, name)
+}
+
+// CredentialFlags holds the command line flags for where credentials are
+// kept, besides the config file
+type CredentialFlags struct {
+	SecretDir string
+	File      string
+	KeyFile   string
+	provider  CredentialProvider
+}
+
+// Register registers --secretdir, --credentials and --keyfile, call
+// before flag.Parse
+func (f *CredentialFlags) Register() {
+	flag.StringVar(&f.SecretDir, "secretdir", "", "read credentials from <secretdir>/<name>/user and password eg --secretdir=/run/secrets")
+	flag.StringVar(&f.File, "credentials", "", "read credentials from this age encrypted json file, see --keyfile")
+	flag.StringVar(&f.KeyFile, "keyfile", "", "age identity file for --credentials, made with age-keygen")
+}
+
+// Provider returns the secret dir, the encrypted file and the
+// environment as a chain, in that order
+func (f *CredentialFlags) Provider() (CredentialProvider, error) {
+	if f.provider != nil {
+		return f.provider, nil
+	}
+	var chain CredentialChain
+	if f.SecretDir != "" {
+		chain = append(chain, SecretDir{Dir: f.SecretDir})
+	}
+	if f.File != "" {
+		if f.KeyFile == "" {
+			return nil, errors.New("--credentials needs --keyfile")
+		}
+		e, err := OpenEncryptedCredentials(f.File, f.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, e)
+	}
+	chain = append(chain, EnvCredentials{})
+	f.provider = chain
+
+	return f.provider, nil
+}
+
+// Lookup returns the credentials for name, or c, eg from the config file,
+// if no provider has any. A password in c is ignored with a warning when
+// a provider has credentials. The user in c is kept if the provider has
+// none.
+func (f *CredentialFlags) Lookup(name string, c Credentials) (Credentials, error) {
+	p, err := f.Provider()
+	if err != nil {
+		return c, err
+	}
+	found, err := p.Credentials(name)
+	if errors.Is(err, ErrNoCredentials) && c.Password != "" {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if c.Password != "" {
+		log.WithFields(log.Fields{"name": name}).Warn("Ignoring the plaintext password in the config, using the secret")
+	}
+	if found.User == "" {
+		found.User = c.User
+	}
+
+	return found, nil
+}
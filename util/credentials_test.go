@@ -0,0 +1,241 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// writeFile writes data to dir/name, creating dirs on the way
+func writeFile(t *testing.T, dir string, name string, data string) string {
+	file := path.Join(dir, name)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// encrypt writes plain encrypted to a new identity as dir/name and
+// returns the file and the identity file
+func encrypt(t *testing.T, dir string, name string, plain string, armored bool) (string, string) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writeFile(t, dir, name+".key", "# created: test\n"+identity.String()+"\n")
+	var out bytes.Buffer
+	var dst io.Writer = &out
+	var a io.WriteCloser
+	if armored {
+		a = armor.NewWriter(&out)
+		dst = a
+	}
+	w, err := age.Encrypt(dst, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if armored {
+		if err = a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return writeFile(t, dir, name, out.String()), keyFile
+}
+
+func TestSecretDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "opac/anders/user", "12345678\n")
+	writeFile(t, dir, "opac/anders/password", "0000\r\n")
+	writeFile(t, dir, "ica/password", "secret")
+	tests := []struct {
+		name     string
+		expected Credentials
+		err      error
+	}{
+		{"opac/anders", Credentials{"12345678", "0000"}, nil},
+		{"ica", Credentials{"", "secret"}, nil},
+		{"opac/hasse", Credentials{}, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		got, err := SecretDir{Dir: dir}.Credentials(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	t.Setenv("OPAC_ANDERS_USER", "12345678")
+	t.Setenv("OPAC_ANDERS_PASSWORD", "0000")
+	t.Setenv("ICA_BETNER_2_PASSWORD", "secret")
+	t.Setenv("OTRAF_USER", "lowe")
+	tests := []struct {
+		name     string
+		expected Credentials
+		err      error
+	}{
+		{"opac/anders", Credentials{"12345678", "0000"}, nil},
+		{"ica/betner-2", Credentials{"", "secret"}, nil},
+		{"otraf", Credentials{}, ErrNoCredentials},
+		{"opac/hasse", Credentials{}, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		got, err := EnvCredentials{}.Credentials(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestEncryptedCredentials(t *testing.T) {
+	plain := `{"opac/anders": {"user": "12345678", "password": "0000"}}`
+	for _, armored := range []bool{false, true} {
+		dir := t.TempDir()
+		file, keyFile := encrypt(t, dir, "credentials.age", plain, armored)
+		e, err := OpenEncryptedCredentials(file, keyFile)
+		if err != nil {
+			t.Fatalf("armored %v: %v", armored, err)
+		}
+		c, err := e.Credentials("opac/anders")
+		if err != nil || c != (Credentials{"12345678", "0000"}) {
+			t.Errorf("armored %v: got %+v %v", armored, c, err)
+		}
+		if _, err = e.Credentials("opac/hasse"); !errors.Is(err, ErrNoCredentials) {
+			t.Errorf("armored %v: error %v, expected %v", armored, err, ErrNoCredentials)
+		}
+	}
+
+	dir := t.TempDir()
+	file, _ := encrypt(t, dir, "credentials.age", plain, false)
+	_, otherKey := encrypt(t, dir, "other.age", plain, false)
+	if _, err := OpenEncryptedCredentials(file, otherKey); err == nil {
+		t.Error("Decrypted with the wrong identity")
+	}
+	file, keyFile := encrypt(t, dir, "broken.age", "not json", false)
+	if _, err := OpenEncryptedCredentials(file, keyFile); err == nil {
+		t.Error("Parsed credentials that aren't json")
+	}
+}
+
+// mapCredentials is a CredentialProvider for tests
+type mapCredentials map[string]Credentials
+
+func (m mapCredentials) Credentials(name string) (Credentials, error) {
+	c, ok := m[name]
+	if !ok {
+		return c, ErrNoCredentials
+	}
+
+	return c, nil
+}
+
+// errorCredentials is a CredentialProvider that always fails with err
+type errorCredentials struct {
+	err error
+}
+
+func (e errorCredentials) Credentials(name string) (Credentials, error) {
+	return Credentials{}, e.err
+}
+
+func TestCredentialChain(t *testing.T) {
+	broken := errors.New("broken")
+	chain := CredentialChain{
+		mapCredentials{"opac/anders": {"first", "1"}},
+		mapCredentials{"opac/anders": {"second", "2"}, "ica": {"second", "2"}},
+		SecretDir{Dir: path.Join(t.TempDir(), "missing")},
+	}
+	tests := []struct {
+		name     string
+		expected Credentials
+		err      error
+	}{
+		{"opac/anders", Credentials{"first", "1"}, nil},
+		{"ica", Credentials{"second", "2"}, nil},
+		{"otraf", Credentials{}, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		got, err := chain.Credentials(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.expected)
+		}
+	}
+	_, err := CredentialChain{errorCredentials{broken}, mapCredentials{"ica": {}}}.Credentials("ica")
+	if !errors.Is(err, broken) {
+		t.Errorf("error %v, expected %v", err, broken)
+	}
+}
+
+func TestCredentialFlagsLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "secrets/opac/anders/user", "12345678")
+	writeFile(t, dir, "secrets/opac/anders/password", "from secret dir")
+	writeFile(t, dir, "secrets/opac/lowe/password", "from secret dir")
+	plain := `{"opac/anders": {"user": "encrypted", "password": "from file"},
+		"opac/hasse": {"user": "encrypted", "password": "from file"}}`
+	file, keyFile := encrypt(t, dir, "credentials.age", plain, true)
+	t.Setenv("OPAC_SIGRID_PASSWORD", "from env")
+	f := &CredentialFlags{}
+	f.SecretDir = path.Join(dir, "secrets")
+	f.File = file
+	f.KeyFile = keyFile
+	tests := []struct {
+		name     string
+		config   Credentials
+		expected Credentials
+		err      error
+	}{
+		{"opac/anders", Credentials{"config", "from config"}, Credentials{"12345678", "from secret dir"}, nil},
+		{"opac/lowe", Credentials{"config", "from config"}, Credentials{"config", "from secret dir"}, nil},
+		{"opac/hasse", Credentials{"config", "from config"}, Credentials{"encrypted", "from file"}, nil},
+		{"opac/sigrid", Credentials{"config", ""}, Credentials{"config", "from env"}, nil},
+		{"opac/ingrid", Credentials{"config", "from config"}, Credentials{"config", "from config"}, nil},
+		{"opac/astrid", Credentials{"config", ""}, Credentials{"config", ""}, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		got, err := f.Lookup(tt.name, tt.config)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, expected %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.expected)
+		}
+	}
+
+	f = &CredentialFlags{}
+	f.File = file
+	if _, err := f.Lookup("opac/anders", Credentials{}); err == nil {
+		t.Error("--credentials without --keyfile gave no error")
+	}
+}
@@ -0,0 +1,339 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	ag "github.com/andersbetner/mqttagent"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var promJobRuns = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ab_job_runs_total",
+		Help: "Scheduled job runs by result, ok or the kind of error.",
+	},
+	[]string{"type", "job", "result"},
+)
+
+// JobStatus is published retained to <daemon>/<job>/status after every
+// run. The job is named by the user or account, so the status is next to
+// the other topics of the account.
+type JobStatus struct {
+	Job      string    `json:"job"`
+	Status   string    `json:"status"` // ok or the kind of error, see ErrorKind
+	Error    string    `json:"error,omitempty"`
+	Failures int       `json:"failures"`
+	Updated  time.Time `json:"updated"`
+}
+
+type subscription struct {
+	topic   string
+	handler mqtt.MessageHandler
+}
+
+// Daemon holds what every collector has in common: flags, the mqtt
+// connection, the prometheus and health endpoint, signal handling and
+// the scheduled jobs
+type Daemon struct {
+	Name            string
+	MQTTHost        string
+	ConfigFile      string
+	ConfigExample   string // Set to require --config eg /etc/users.json
+	ConfigOptional  bool   // --config may be left out, eg an env fallback
+	UpdateInterval  int    // Default minutes between scheduled jobs
+	Jitter          int    // Max random minutes added to UpdateInterval
+	QuietHours      string // Eg 23-6, no scheduled jobs during these hours
+	MetricsAddress  string
+	ShutdownTimeout time.Duration // Max wait for jobs and Publish on shutdown
+	Agent           *ag.Agent
+	Scheduler       *Scheduler // Jobs added here are run until shutdown
+	// Scheduled registers the scheduling flags. Set by Schedule, or set it
+	// before ParseFlags if jobs are added after the config is loaded.
+	Scheduled     bool
+	subscriptions []subscription
+	ctx           context.Context
+	cancel        context.CancelFunc
+	busy          sync.WaitGroup // Jobs and publishes in flight
+	busyMu        sync.Mutex     // Held while adding to busy and when shutdown starts
+	servers       sync.WaitGroup
+}
+
+// NewDaemon returns a Daemon with default values
+func NewDaemon(name string) *Daemon {
+	log.SetLevel(log.DebugLevel)
+	d := &Daemon{}
+	d.Name = name
+	d.UpdateInterval = 30
+	d.MetricsAddress = ":9100"
+	d.ShutdownTimeout = 10 * time.Second
+	d.Scheduler = NewScheduler()
+	d.Scheduler.Result = d.jobResult
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	return d
+}
+
+// Context returns a context that is cancelled when the daemon shuts down
+func (d *Daemon) Context() context.Context {
+	return d.ctx
+}
+
+// ParseFlags registers the common flags, parses the command line and
+// returns true if anything required is missing
+func (d *Daemon) ParseFlags() (exit bool) {
+	flag.StringVar(&d.MQTTHost, "mqtthost", "", "address and port for mqtt server eg tcp://example.com:1883")
+	if d.ConfigExample != "" {
+		flag.StringVar(&d.ConfigFile, "config", "", "full path to configfile eg --config="+d.ConfigExample+" ")
+	}
+	if d.Scheduled {
+		flag.IntVar(&d.UpdateInterval, "updateinterval", d.UpdateInterval, "integer > 0")
+		flag.IntVar(&d.Jitter, "jitter", d.Jitter, "max random minutes added to updateinterval")
+		flag.StringVar(&d.QuietHours, "quiethours", d.QuietHours, "hours without updates eg --quiethours=23-6")
+	}
+	flag.Parse()
+	if d.MQTTHost == "" {
+		os.Stderr.WriteString("--mqtthost missing eg --mqtthost=tcp://example.com:1883\n")
+		exit = true
+	}
+	if d.ConfigExample != "" && d.ConfigFile == "" && !d.ConfigOptional {
+		os.Stderr.WriteString("--config missing eg --config=" + d.ConfigExample + "\n")
+		exit = true
+	}
+	if d.Scheduled && d.UpdateInterval < 1 {
+		os.Stderr.WriteString("--updateinterval must be an integer > 0\n")
+		exit = true
+	}
+	quiet, err := ParseQuietHours(d.QuietHours)
+	if err != nil {
+		os.Stderr.WriteString("--quiethours " + err.Error() + "\n")
+		exit = true
+	}
+	d.Scheduler.Interval = time.Duration(d.UpdateInterval) * time.Minute
+	d.Scheduler.Jitter = time.Duration(d.Jitter) * time.Minute
+	d.Scheduler.Quiet = quiet
+
+	return exit
+}
+
+// LoadConfig unmarshals the json in --config into v and exits on failure
+func (d *Daemon) LoadConfig(v interface{}) {
+	jsonStr, err := ioutil.ReadFile(d.ConfigFile)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Can't read %s\n", d.ConfigFile))
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	err = json.Unmarshal(jsonStr, v)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Can't unmarshal json in %s\n", d.ConfigFile))
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+}
+
+// Subscribe registers a handler that is subscribed once Run has connected
+func (d *Daemon) Subscribe(topic string, handler mqtt.MessageHandler) {
+	d.subscriptions = append(d.subscriptions, subscription{topic, handler})
+}
+
+// Serve runs a webserver that is shut down together with the daemon
+func (d *Daemon) Serve(name string, address string, handler http.Handler) {
+	d.servers.Add(1)
+	go func() {
+		defer d.servers.Done()
+		Webserver(d.ctx, name, address, handler)
+	}()
+}
+
+// start adds work to busy, false once shutdown has begun. Adding after
+// shutdown has started waiting on busy would race with the wait.
+func (d *Daemon) start() bool {
+	d.busyMu.Lock()
+	defer d.busyMu.Unlock()
+	if d.ctx.Err() != nil {
+		return false
+	}
+	d.busy.Add(1)
+
+	return true
+}
+
+// Publish publishes to mqtt once Run has connected. Publishes in flight
+// are waited for before mqtt is disconnected on shutdown, new ones are
+// rejected.
+func (d *Daemon) Publish(topic string, retain bool, payload string) error {
+	if d.Agent == nil {
+		return errors.New("Not connected to mqtt")
+	}
+	if !d.start() {
+		return errors.New("Shutting down")
+	}
+	defer d.busy.Done()
+
+	return d.Agent.Publish(topic, retain, payload)
+}
+
+// Go runs f in a goroutine with the daemon context, eg for mqtt commands
+// that shouldn't block the mqtt client. Shutdown waits for f like for jobs,
+// f isn't run once shutdown has begun.
+func (d *Daemon) Go(f func(ctx context.Context)) {
+	if !d.start() {
+		log.Debug("Shutting down, not starting")
+		return
+	}
+	go func() {
+		defer d.busy.Done()
+		f(d.ctx)
+	}()
+}
+
+// Schedule adds a job to the scheduler
+func (d *Daemon) Schedule(job *Job) {
+	d.Scheduled = true
+	d.Scheduler.Add(job)
+}
+
+// jobResult counts the run and publishes the job status
+func (d *Daemon) jobResult(job *Job, err error) {
+	status := JobStatus{}
+	status.Job = job.Name
+	status.Status = ErrorKind(err)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Failures = job.Failures()
+	status.Updated = time.Now()
+	promJobRuns.WithLabelValues(d.Name, job.Name, status.Status).Inc()
+	out, err := json.Marshal(status)
+	if err != nil {
+		log.WithField("error", err).Error("Error marshal job status")
+
+		return
+	}
+	err = d.Publish(d.Name+"/"+job.Name+"/status", true, string(out))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"job": job.Name}).Error("Error publish job status")
+	}
+}
+
+// Healthy returns true if mqtt is connected and no job has stalled
+func (d *Daemon) Healthy() bool {
+	if d.Agent == nil || d.Agent.IsTerminated() {
+		return false
+	}
+
+	return !d.Scheduler.Stalled()
+}
+
+func (d *Daemon) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !d.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "unhealthy")
+
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (d *Daemon) connect() (err error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = d.Name
+	}
+	d.Agent = ag.NewAgent(d.MQTTHost, d.Name+"-"+host)
+	for i := 0; i < 5; i++ {
+		err = d.Agent.Connect()
+		if err == nil {
+			break
+		}
+		log.WithField("error", err).Warn("Can't connect to mqtt server, retrying")
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range d.subscriptions {
+		d.Agent.Subscribe(s.topic, s.handler)
+	}
+
+	return nil
+}
+
+// shutdown waits for jobs and publishes in flight and disconnects mqtt
+func (d *Daemon) shutdown() {
+	log.Info("Shutting down ", d.Name)
+	// Nothing is added to busy after this
+	d.busyMu.Lock()
+	d.cancel()
+	d.busyMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.busy.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d.ShutdownTimeout):
+		log.Warn("Timeout waiting for jobs and publish to finish")
+	}
+	d.Agent.Terminate()
+	d.servers.Wait()
+}
+
+// Run connects to mqtt, serves /metrics and /health and runs the
+// scheduled jobs until SIGINT or SIGTERM
+func (d *Daemon) Run() {
+	go func() {
+		done := make(chan os.Signal, 1)
+		signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-done:
+			d.cancel()
+		case <-d.ctx.Done():
+		}
+	}()
+	prometheus.MustRegister(promJobRuns)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/health", d.healthHandler)
+	d.Serve(d.Name+" metrics", d.MetricsAddress, mux)
+
+	err := d.connect()
+	if err != nil {
+		log.WithField("error", err).Error("Can't connect to mqtt server")
+		d.cancel()
+		d.servers.Wait()
+		os.Exit(1)
+	}
+
+	d.Go(d.Scheduler.Run)
+
+	for !d.Agent.IsTerminated() {
+		select {
+		case <-d.ctx.Done():
+			d.shutdown()
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+	d.cancel()
+	d.servers.Wait()
+}
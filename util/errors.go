@@ -0,0 +1,94 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of scraper errors, test with errors.Is
+var (
+	// ErrAuthFailed means the site rejected the credentials, retrying
+	// soon risks locking the account
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrLayoutChanged means the page didn't look like expected, most
+	// likely a redesign, retrying soon won't help
+	ErrLayoutChanged = errors.New("page layout changed")
+	// ErrUpstreamUnavailable means the site couldn't be reached or had
+	// problems, worth retrying soon
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+)
+
+// ScrapeError is an error of one of the kinds above
+type ScrapeError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ScrapeError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrAuthFailed) etc work
+func (e *ScrapeError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// WrapError returns err as an error of kind, nil if err is nil. Errors
+// that already have a kind and cancelled contexts are returned as is.
+func WrapError(kind error, err error) error {
+	if err == nil || ErrorKind(err) != "unknown" ||
+		errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	return &ScrapeError{Kind: kind, Err: err}
+}
+
+// Errorf formats an error of kind
+func Errorf(kind error, format string, a ...interface{}) error {
+	return &ScrapeError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// ErrorKind returns a short name for the kind of err, used as prometheus
+// label and in the mqtt status topic
+func ErrorKind(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, ErrLayoutChanged):
+		return "layout_changed"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "upstream_unavailable"
+	}
+
+	return "unknown"
+}
+
+// CheckResponse classifies the result of http.Client.Do. Network errors
+// and 5xx or 429 responses are ErrUpstreamUnavailable, 401 and 403 are
+// ErrAuthFailed. The body is closed if an error is returned.
+func CheckResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return resp, WrapError(ErrUpstreamUnavailable, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		err = Errorf(ErrAuthFailed, "%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		err = Errorf(ErrUpstreamUnavailable, "%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	default:
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	return resp, err
+}
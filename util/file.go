@@ -42,3 +42,29 @@ func CopyFile(dst string, src string) error {
 	}
 	return nil
 }
+
+// WriteFileAtomic writes data to a temp file next to file and renames it
+// to file, a crash leaves either the old or the new file
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
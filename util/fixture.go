@@ -0,0 +1,243 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Fixture is a recorded http response stored as json in a testdata dir
+type Fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+var fixtureNameRex = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// queryHash returns a short hash of the sorted query, empty if there is
+// none. Requests to the same path with different queries get different
+// fixtures, eg search pages.
+func queryHash(u *url.URL) string {
+	query := u.Query().Encode()
+	if query == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(query))
+
+	return hex.EncodeToString(sum[:4])
+}
+
+// FixtureName returns the file name for a request, the query is hashed
+// into the name
+func FixtureName(method string, u *url.URL) string {
+	name := strings.ToLower(method) + "_" + u.Host + "_" + strings.Trim(u.Path, "/")
+	name = strings.Trim(fixtureNameRex.ReplaceAllString(name, "_"), "_")
+	if hash := queryHash(u); hash != "" {
+		name += "_" + hash
+	}
+
+	return name + ".json"
+}
+
+// sensitiveHeaders are never written to fixtures
+var sensitiveHeaders = []string{"Set-Cookie", "Cookie", "Authorization", "Authenticationticket"}
+
+// RecordingTransport passes requests on to Transport and saves sanitized
+// responses as fixtures in Dir
+type RecordingTransport struct {
+	Dir       string
+	Transport http.RoundTripper // http.DefaultTransport if nil
+	Secrets   []string          // Replaced with XXX, eg user names and passwords
+}
+
+func (t *RecordingTransport) sanitize(str string) string {
+	for _, secret := range t.Secrets {
+		if secret == "" {
+			continue
+		}
+		str = strings.Replace(str, secret, "XXX", -1)
+		str = strings.Replace(str, url.QueryEscape(secret), "XXX", -1)
+	}
+
+	return str
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	f := Fixture{}
+	f.Method = req.Method
+	f.URL = t.sanitize(req.URL.String())
+	f.Status = resp.StatusCode
+	f.Header = http.Header{}
+	for name, values := range resp.Header {
+		for _, value := range values {
+			f.Header.Add(name, t.sanitize(value))
+		}
+	}
+	for _, name := range sensitiveHeaders {
+		if f.Header.Get(name) != "" {
+			f.Header.Set(name, "XXX")
+		}
+	}
+	// Bodies are stored decoded
+	f.Header.Del("Content-Encoding")
+	f.Header.Del("Content-Length")
+	f.Body = t.sanitize(string(body))
+	out, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return resp, err
+	}
+	// Name the fixture from the sanitized url, secrets in the query must
+	// not end up hashed into the name and a replay with XXX finds it
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return resp, err
+	}
+	err = os.MkdirAll(t.Dir, 0775)
+	if err != nil {
+		return resp, err
+	}
+	err = ioutil.WriteFile(path.Join(t.Dir, FixtureName(req.Method, u)), out, 0644)
+
+	return resp, err
+}
+
+// LoadFixture reads the fixture for a request from dir
+func LoadFixture(dir string, method string, u *url.URL) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, FixtureName(method, u)))
+	if err != nil {
+		return nil, fmt.Errorf("No fixture for %s %s: %v", method, u, err)
+	}
+	f := &Fixture{}
+	err = json.Unmarshal(data, f)
+
+	return f, err
+}
+
+// Response returns the fixture as a response to req
+func (f *Fixture) Response(req *http.Request) *http.Response {
+	resp := &http.Response{}
+	resp.Status = fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status))
+	resp.StatusCode = f.Status
+	resp.Proto = "HTTP/1.1"
+	resp.ProtoMajor = 1
+	resp.ProtoMinor = 1
+	resp.Header = http.Header{}
+	for name, values := range f.Header {
+		resp.Header[name] = append([]string{}, values...)
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(f.Body))
+	resp.ContentLength = int64(len(f.Body))
+	resp.Request = req
+
+	return resp
+}
+
+// ReplayTransport answers requests with fixtures from Dir and never
+// touches the network
+type ReplayTransport struct {
+	Dir string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	f, err := LoadFixture(t.Dir, req.Method, req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Response(req), nil
+}
+
+// FixtureServer is a local stand-in for the scraped sites. Requests are
+// answered with the fixture recorded for the same method, path and query
+// on any host, and absolute redirects are rewritten to point back at the
+// server.
+type FixtureServer struct {
+	fixtures map[string]*Fixture
+}
+
+// NewFixtureServer loads all fixtures in dir
+func NewFixtureServer(dir string) (*FixtureServer, error) {
+	s := &FixtureServer{}
+	s.fixtures = make(map[string]*Fixture)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return s, err
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return s, err
+		}
+		f := &Fixture{}
+		if err = json.Unmarshal(data, f); err != nil || f.Method == "" {
+			// Not a fixture, eg expected output
+			continue
+		}
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return s, err
+		}
+		s.fixtures[f.Method+" "+u.Path+" "+queryHash(u)] = f
+	}
+
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *FixtureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.fixtures[r.Method+" "+r.URL.Path+" "+queryHash(r.URL)]
+	if !ok {
+		http.Error(w, "No fixture for "+r.Method+" "+r.URL.String(), http.StatusNotFound)
+
+		return
+	}
+	for name, values := range f.Header {
+		for _, value := range values {
+			if name == "Location" {
+				if loc, err := url.Parse(value); err == nil && loc.Host != "" {
+					loc.Scheme = ""
+					loc.Host = ""
+					value = loc.String()
+				}
+			}
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(f.Status)
+	fmt.Fprint(w, f.Body)
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Golden compares got as indented json with the expected json in file,
+// eg testdata/expected.json, and rewrites file instead if update is set
+func Golden(file string, got interface{}, update bool) error {
+	out, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if update {
+		return ioutil.WriteFile(file, out, 0644)
+	}
+	expected, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, out) {
+		return fmt.Errorf("%s differs\n--- expected\n%s--- got\n%s", file, expected, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package util
+
+import (
+	"flag"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// ClientOptions configures the scraping clients in ica, opac and otraf
+type ClientOptions struct {
+	BaseURL    string // Replaces scheme and host of the site, eg a local mock
+	HTTPClient *http.Client
+	Transport  http.RoundTripper
+	Timeout    time.Duration
+	UserAgent  string
+	CookieFile string // Cookies are saved here and survive restarts
+}
+
+// ClientOption sets a ClientOptions value
+type ClientOption func(*ClientOptions)
+
+// WithBaseURL points the client at another site, eg a local mock
+func WithBaseURL(baseURL string) ClientOption {
+	return func(o *ClientOptions) {
+		o.BaseURL = baseURL
+	}
+}
+
+// WithHTTPClient uses a copy of client, a cookie jar is added if it has
+// none. The copy keeps clients for different users from sharing a jar.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(o *ClientOptions) {
+		o.HTTPClient = client
+	}
+}
+
+// WithTransport uses transport for all requests, eg with a proxy
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return func(o *ClientOptions) {
+		o.Transport = transport
+	}
+}
+
+// WithTimeout sets the timeout for every request, also on a client from
+// WithHTTPClient
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(o *ClientOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent header on every request
+func WithUserAgent(userAgent string) ClientOption {
+	return func(o *ClientOptions) {
+		o.UserAgent = userAgent
+	}
+}
+
+// WithCookieFile keeps the cookies in file, see FileJar
+func WithCookieFile(file string) ClientOption {
+	return func(o *ClientOptions) {
+		o.CookieFile = file
+	}
+}
+
+// defaultTimeout is used unless WithTimeout or the client from
+// WithHTTPClient sets one
+const defaultTimeout = 30 * time.Second
+
+// NewClientOptions applies opts to the default options
+func NewClientOptions(opts ...ClientOption) *ClientOptions {
+	o := &ClientOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// URL returns BaseURL if set and def otherwise, without trailing slash
+func (o *ClientOptions) URL(def string) string {
+	if o.BaseURL != "" {
+		return strings.TrimRight(o.BaseURL, "/")
+	}
+
+	return strings.TrimRight(def, "/")
+}
+
+type userAgentTransport struct {
+	userAgent string
+	transport http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	return t.transport.RoundTrip(req)
+}
+
+// NewHTTPClient returns a new http.Client with a cookie jar set up from
+// the options, the client from WithHTTPClient is never changed
+func (o *ClientOptions) NewHTTPClient() (*http.Client, error) {
+	client := &http.Client{}
+	if o.HTTPClient != nil {
+		c := *o.HTTPClient
+		client = &c
+	}
+	if o.Timeout != 0 {
+		client.Timeout = o.Timeout
+	}
+	if client.Timeout == 0 {
+		client.Timeout = defaultTimeout
+	}
+	if client.Jar == nil && o.CookieFile != "" {
+		jar, err := NewFileJar(o.CookieFile)
+		if err != nil {
+			return client, err
+		}
+		client.Jar = jar
+	}
+	if client.Jar == nil {
+		jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+		if err != nil {
+			return client, err
+		}
+		client.Jar = jar
+	}
+	if o.Transport != nil {
+		client.Transport = o.Transport
+	}
+	if o.UserAgent != "" {
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		client.Transport = &userAgentTransport{o.UserAgent, transport}
+	}
+
+	return client, nil
+}
+
+// ClientFlags holds the command line flags for the scraping clients
+type ClientFlags struct {
+	BaseURL   string
+	Timeout   int
+	UserAgent string
+}
+
+// Register registers --baseurl, --timeout and --useragent, call before
+// flag.Parse
+func (f *ClientFlags) Register() {
+	flag.StringVar(&f.BaseURL, "baseurl", "", "use another site than the real one eg --baseurl=http://localhost:8081")
+	flag.IntVar(&f.Timeout, "timeout", 30, "http timeout in seconds")
+	flag.StringVar(&f.UserAgent, "useragent", "", "User-Agent header for requests")
+}
+
+// Options returns the flags as client options
+func (f *ClientFlags) Options() []ClientOption {
+	opts := []ClientOption{WithTimeout(time.Duration(f.Timeout) * time.Second)}
+	if f.BaseURL != "" {
+		opts = append(opts, WithBaseURL(f.BaseURL))
+	}
+	if f.UserAgent != "" {
+		opts = append(opts, WithUserAgent(f.UserAgent))
+	}
+
+	return opts
+}
@@ -0,0 +1,24 @@
+package util
+
+import "time"
+
+// Ica holds the funds on an ICA card account
+type Ica struct {
+	Name      string
+	Balance   float64
+	Available float64
+}
+
+// IcaBonus holds the bonus and discounts on an ICA account
+type IcaBonus struct {
+	Name              string             `json:"name"`
+	Year              int                `json:"year"`
+	Level             int                `json:"level"`
+	Percentage        float64            `json:"percentage"`
+	Acquired          float64            `json:"acquired"` // Bonus this year
+	AmountToNextLevel float64            `json:"amount_to_next_level"`
+	Months            [12]float64        `json:"months"`   // Discount per month
+	Stores            map[string]float64 `json:"stores"`   // Discount this year per store
+	Discount          float64            `json:"discount"` // This year
+	Updated           time.Time          `json:"updated"`
+}
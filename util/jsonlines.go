@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadJSONLines calls decode with every line in file, a missing file has
+// no lines. An invalid last line, eg cut short by a crash, is dropped with
+// a warning and the file is rewritten without it so appends start on a
+// new line. An invalid line anywhere else is an error.
+func ReadJSONLines(file string, decode func(line []byte) error) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	end := 0 // Length of the valid lines in data
+	for i, line := range lines {
+		if len(line) == 0 {
+			end++
+			continue
+		}
+		err = decode(line)
+		if err != nil && i == len(lines)-1 {
+			log.WithFields(log.Fields{"error": err, "file": file}).Warn("Dropping invalid last line")
+
+			return WriteFileAtomic(file, data[:end], 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", file, i+1, err)
+		}
+		end += len(line) + 1
+	}
+	if end > len(data) {
+		// Last line without newline, complete it
+		return WriteFileAtomic(file, append(data, '\n'), 0644)
+	}
+
+	return nil
+}
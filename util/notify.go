@@ -0,0 +1,231 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification is a message to a person
+type Notification struct {
+	Name    string      `json:"name"` // Who it's for
+	Type    string      `json:"type"` // Eg pickup
+	Subject string      `json:"subject"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"` // The event notified about
+	Time    time.Time   `json:"time"`
+}
+
+// Notifier sends notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifierConfig configures a notifier in a config file
+type NotifierConfig struct {
+	Type     string   `json:"type"`  // webhook, ntfy or smtp
+	URL      string   `json:"url"`   // Webhook url or ntfy topic url eg https://ntfy.sh/mytopic
+	Token    string   `json:"token"` // ntfy access token
+	Host     string   `json:"host"`  // smtp host:port
+	User     string   `json:"user"`  // smtp user, no auth if empty
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// NewNotifier returns the notifier for c
+func NewNotifier(c NotifierConfig) (Notifier, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch c.Type {
+	case "webhook":
+		if c.URL == "" {
+			return nil, errors.New("webhook notifier needs a url")
+		}
+		return &WebhookNotifier{URL: c.URL, Client: client}, nil
+	case "ntfy":
+		if c.URL == "" {
+			return nil, errors.New("ntfy notifier needs a url")
+		}
+		return &NtfyNotifier{URL: c.URL, Token: c.Token, Client: client}, nil
+	case "smtp":
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return nil, errors.New("smtp notifier needs host, from and to")
+		}
+		return &SMTPNotifier{Host: c.Host, User: c.User, Password: c.Password, From: c.From, To: c.To}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown notifier type %s", c.Type)
+}
+
+// NewNotifiers returns a notifier for every config in configs
+func NewNotifiers(configs []NotifierConfig) (Notifiers, error) {
+	var notifiers Notifiers
+	for _, c := range configs {
+		n, err := NewNotifier(c)
+		if err != nil {
+			return notifiers, err
+		}
+		notifiers = append(notifiers, n)
+	}
+
+	return notifiers, nil
+}
+
+// Notifiers sends to every notifier in the list
+type Notifiers []Notifier
+
+// Notify implements Notifier, the first error is returned after trying
+// every notifier
+func (l Notifiers) Notify(ctx context.Context, n Notification) error {
+	var first error
+	for _, notifier := range l {
+		if err := notifier.Notify(ctx, n); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// post posts body to url and checks the response
+func post(ctx context.Context, client *http.Client, url string, contentType string, body []byte, header http.Header) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", contentType)
+	resp, err := CheckResponse(client.Do(request))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Notify %s: %s", url, resp.Status)
+	}
+
+	return nil
+}
+
+// WebhookNotifier posts the notification as json to URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, w.Client, w.URL, "application/json", body, nil)
+}
+
+// NtfyNotifier publishes to an ntfy compatible topic url
+type NtfyNotifier struct {
+	URL    string
+	Token  string // Sent as bearer token if set
+	Client *http.Client
+}
+
+// Notify implements Notifier
+func (t *NtfyNotifier) Notify(ctx context.Context, n Notification) error {
+	header := http.Header{}
+	header.Set("Title", mime.QEncoding.Encode("utf-8", n.Subject))
+	if n.Type != "" {
+		header.Set("Tags", n.Type)
+	}
+	if t.Token != "" {
+		header.Set("Authorization", "Bearer "+t.Token)
+	}
+
+	return post(ctx, t.Client, t.URL, "text/plain; charset=utf-8", []byte(n.Message), header)
+}
+
+// SMTPNotifier sends the notification as email
+type SMTPNotifier struct {
+	Host     string // host:port
+	User     string // No auth if empty
+	Password string
+	From     string
+	To       []string
+}
+
+// Notify implements Notifier. The connection is closed if ctx is done,
+// so a hanging server can't block shutdown.
+func (m *SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	host, _, err := net.SplitHostPort(m.Host)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", m.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.User, m.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + strings.Join(m.To, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", n.Subject) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + n.Message + "\r\n"
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -12,6 +12,12 @@ type Opac struct {
 		DateDue     time.Time `json:"date_due"`
 		LibraryName string    `json:"library_name"`
 		Renewable   bool      `json:"renewable"`
+		Author      string    `json:"author"`
+		RecordID    string    `json:"record_id"`
+		ISBN        string    `json:"isbn"`
+		MediaType   string    `json:"media_type"`
+		DateLoaned  time.Time `json:"date_loaned"`
+		CoverURL    string    `json:"cover_url"`
 	} `json:"books"`
 	Reservations []struct {
 		Title        string    `json:"title"`
@@ -19,5 +25,22 @@ type Opac struct {
 		BooksTotal   int       `json:"books_total"`
 		PickupDue    time.Time `json:"pickup_due"`
 		PickupNumber int       `json:"pickup_number"`
+		RecordID     string    `json:"record_id"`
+		Branch       string    `json:"branch"`
 	} `json:"reservations"`
+	Debts []struct {
+		Title  string    `json:"title"`
+		Reason string    `json:"reason"`
+		Date   time.Time `json:"date"`
+		Amount float64   `json:"amount"`
+	} `json:"debts"`
+}
+
+// OpacStats holds reading statistics for a user
+type OpacStats struct {
+	Name    string    `json:"name"`
+	Year    int       `json:"year"`
+	Months  [12]int   `json:"months"` // Loans borrowed per month
+	Total   int       `json:"total"`
+	Updated time.Time `json:"updated"`
 }
@@ -9,4 +9,30 @@ type Otraf struct {
 	Amount      int       `json:"amount"`
 	Updated     time.Time `json:"updated"`
 	CardUpdated time.Time `json:"card_updated"`
+	Products    []struct {
+		Type  string    `json:"type"` // period, trips or value
+		Name  string    `json:"name"`
+		Zone  string    `json:"zone"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Trips int       `json:"trips"`
+		Value int       `json:"value"`
+	} `json:"products"`
+}
+
+// OtrafMonth sums up the card transactions in a month
+type OtrafMonth struct {
+	Trips int `json:"trips"`
+	Spent int `json:"spent"` // SEK paid for trips, passes and trips bought
+	TopUp int `json:"topup"` // SEK loaded on the card
+}
+
+// OtrafSpend holds the monthly spend on a card
+type OtrafSpend struct {
+	Name    string         `json:"name"`
+	Year    int            `json:"year"`
+	Months  [12]OtrafMonth `json:"months"`
+	Spent   int            `json:"spent"` // This year
+	Trips   int            `json:"trips"` // This year
+	Updated time.Time      `json:"updated"`
 }
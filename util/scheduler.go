@@ -0,0 +1,324 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// QuietHours is a daily window, in local time, when scheduled runs are
+// skipped. Start == End means no quiet hours.
+type QuietHours struct {
+	Start int // Hour 0-23
+	End   int // Hour 0-23
+}
+
+// ParseQuietHours parses "23-6" into QuietHours, "" gives no quiet hours
+func ParseQuietHours(str string) (q QuietHours, err error) {
+	if str == "" {
+		return q, nil
+	}
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return q, errors.New("Quiet hours must look like 23-6")
+	}
+	q.Start, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return q, err
+	}
+	q.End, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return q, err
+	}
+	if q.Start < 0 || q.Start > 23 || q.End < 0 || q.End > 23 {
+		return q, fmt.Errorf("Quiet hours out of range: %s", str)
+	}
+
+	return q, nil
+}
+
+// Contains returns true if t is within the quiet hours
+func (q QuietHours) Contains(t time.Time) bool {
+	if q.Start == q.End {
+		return false
+	}
+	h := t.Hour()
+	if q.Start < q.End {
+		return h >= q.Start && h < q.End
+	}
+
+	return h >= q.Start || h < q.End
+}
+
+// end returns when the quiet hours that t is in are over
+func (q QuietHours) end(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.End, 0, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	return end
+}
+
+// Job is run by a Scheduler. Zero values are filled in from the
+// Scheduler defaults when the Scheduler starts.
+//
+// How long to wait after a failure depends on the kind of error, see
+// ErrorKind. ErrUpstreamUnavailable and unknown errors back off from
+// MinBackoff, ErrLayoutChanged waits MaxBackoff and ErrAuthFailed waits
+// AuthBackoff and ignores triggers meanwhile.
+type Job struct {
+	Name        string
+	Interval    time.Duration // Between successful runs
+	Jitter      time.Duration // Up to Jitter is randomly added to every wait
+	MinBackoff  time.Duration // Wait after the first failure, doubled for every failure
+	MaxBackoff  time.Duration // Cap for the wait after failures
+	AuthBackoff time.Duration // Wait after ErrAuthFailed
+	Quiet       *QuietHours   // Scheduled runs are skipped during quiet hours
+	Run         func(ctx context.Context) error
+	trigger     chan struct{}
+	mu          sync.Mutex
+	failures    int
+	err         error     // Error from the last run
+	running     time.Time // Start of the current run, zero if not running
+	finished    time.Time
+}
+
+// Failures returns the number of failed runs in a row
+func (j *Job) Failures() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.failures
+}
+
+// wait returns how long to wait before the next scheduled run
+func (j *Job) wait(now time.Time) time.Duration {
+	j.mu.Lock()
+	failures := j.failures
+	err := j.err
+	j.mu.Unlock()
+	wait := j.Interval
+	switch {
+	case failures == 0:
+	case errors.Is(err, ErrAuthFailed):
+		wait = j.AuthBackoff
+	case errors.Is(err, ErrLayoutChanged):
+		wait = j.MaxBackoff
+	default:
+		wait = j.MinBackoff
+		for i := 1; i < failures && wait < j.MaxBackoff; i++ {
+			wait *= 2
+		}
+		if wait > j.MaxBackoff {
+			wait = j.MaxBackoff
+		}
+	}
+	if j.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(j.Jitter)))
+	}
+	if next := now.Add(wait); j.Quiet.Contains(next) {
+		wait = j.Quiet.end(next).Sub(now)
+	}
+
+	return wait
+}
+
+func (j *Job) run(ctx context.Context) error {
+	j.mu.Lock()
+	j.running = time.Now()
+	j.mu.Unlock()
+	err := j.Run(ctx)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.running = time.Time{}
+	j.finished = time.Now()
+	if err != nil && ctx.Err() == nil {
+		j.failures++
+		j.err = err
+		log.WithFields(log.Fields{"error": err,
+			"job":      j.Name,
+			"kind":     ErrorKind(err),
+			"failures": j.failures}).Warn("Job failed, backing off")
+
+		return err
+	}
+	j.failures = 0
+	j.err = nil
+
+	return nil
+}
+
+// Scheduler runs jobs on their own intervals with jitter, backoff on
+// failure, quiet hours and debounced on demand triggers
+type Scheduler struct {
+	Interval    time.Duration
+	Jitter      time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	AuthBackoff time.Duration
+	Quiet       QuietHours
+	Debounce    time.Duration // Triggers during a run or this soon after are ignored
+	// Result is called after every run that wasn't cancelled, err is nil
+	// on success
+	Result func(job *Job, err error)
+	jobs   []*Job
+}
+
+// NewScheduler returns a Scheduler with default values
+func NewScheduler() *Scheduler {
+	s := &Scheduler{}
+	s.Interval = 30 * time.Minute
+	s.MinBackoff = time.Minute
+	s.AuthBackoff = 6 * time.Hour
+	s.Debounce = time.Minute
+
+	return s
+}
+
+// Add adds a job, must be called before Run
+func (s *Scheduler) Add(job *Job) {
+	job.trigger = make(chan struct{}, 1)
+	s.jobs = append(s.jobs, job)
+}
+
+// Len returns the number of jobs
+func (s *Scheduler) Len() int {
+	return len(s.jobs)
+}
+
+// Trigger runs the job named name, or every job if name is "", as soon as
+// possible. A job is never run concurrently with itself and triggers
+// arriving while it runs, just after or while a run is pending are
+// dropped.
+func (s *Scheduler) Trigger(name string) {
+	s.triggerAt(name, time.Now())
+}
+
+func (s *Scheduler) triggerAt(name string, now time.Time) {
+	for _, j := range s.jobs {
+		if name != "" && j.Name != name {
+			continue
+		}
+		j.mu.Lock()
+		// A trigger during a run would run the job again right after it
+		recent := !j.running.IsZero() || now.Sub(j.finished) < s.Debounce
+		authFailed := errors.Is(j.err, ErrAuthFailed)
+		j.mu.Unlock()
+		if recent {
+			log.WithField("job", j.Name).Debug("Trigger ignored, job is running or just ran")
+			continue
+		}
+		if authFailed {
+			log.WithField("job", j.Name).Warn("Trigger ignored, login failed last run")
+			continue
+		}
+		select {
+		case j.trigger <- struct{}{}:
+		default:
+			log.WithField("job", j.Name).Debug("Trigger ignored, run already pending")
+		}
+	}
+}
+
+// TriggerHandler returns an mqtt handler that triggers the job named as
+// the payload, or every job if the payload isn't a job name
+func (s *Scheduler) TriggerHandler() mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		name := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+		log.WithFields(log.Fields{"topic": msg.Topic(),
+			"command": name}).Debug("Update requested through mqtt")
+		for _, j := range s.jobs {
+			if j.Name == name {
+				s.Trigger(name)
+
+				return
+			}
+		}
+		s.Trigger("")
+	}
+}
+
+// Stalled returns true if any job has been running for longer than its
+// interval
+func (s *Scheduler) Stalled() bool {
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		running := j.running
+		j.mu.Unlock()
+		if !running.IsZero() && time.Since(running) > j.Interval {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *Job) {
+	// First run at once unless it's quiet hours
+	var wait time.Duration
+	if now := time.Now(); j.Quiet.Contains(now) {
+		wait = j.Quiet.end(now).Sub(now)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-j.trigger:
+		}
+		// This run answers a trigger that came in just before it
+		select {
+		case <-j.trigger:
+		default:
+		}
+		err := j.run(ctx)
+		if s.Result != nil && ctx.Err() == nil {
+			s.Result(j, err)
+		}
+		wait = j.wait(time.Now())
+	}
+}
+
+// Run runs all jobs until ctx is cancelled and returns when every job
+// has finished
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		if j.Interval == 0 {
+			j.Interval = s.Interval
+		}
+		if j.Jitter == 0 {
+			j.Jitter = s.Jitter
+		}
+		if j.MinBackoff == 0 {
+			j.MinBackoff = s.MinBackoff
+		}
+		if j.MaxBackoff == 0 {
+			j.MaxBackoff = s.MaxBackoff
+		}
+		if j.MaxBackoff == 0 {
+			j.MaxBackoff = j.Interval
+		}
+		if j.AuthBackoff == 0 {
+			j.AuthBackoff = s.AuthBackoff
+		}
+		if j.Quiet == nil {
+			j.Quiet = &s.Quiet
+		}
+		wg.Add(1)
+		go func(j *Job) {
+			defer wg.Done()
+			s.loop(ctx, j)
+		}(j)
+	}
+	wg.Wait()
+}
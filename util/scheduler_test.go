@@ -0,0 +1,156 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func at(hour int, min int) time.Time {
+	return time.Date(2020, 3, 1, hour, min, 0, 0, time.UTC)
+}
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		str      string
+		expected QuietHours
+		err      bool
+	}{
+		{"", QuietHours{}, false},
+		{"23-6", QuietHours{23, 6}, false},
+		{" 8 - 17 ", QuietHours{8, 17}, false},
+		{"0-0", QuietHours{}, false},
+		{"23", QuietHours{}, true},
+		{"23-6-7", QuietHours{}, true},
+		{"a-6", QuietHours{}, true},
+		{"23-b", QuietHours{}, true},
+		{"24-6", QuietHours{}, true},
+		{"23-24", QuietHours{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuietHours(tt.str)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseQuietHours(%q) error %v", tt.str, err)
+			continue
+		}
+		if !tt.err && got != tt.expected {
+			t.Errorf("ParseQuietHours(%q) = %v, expected %v", tt.str, got, tt.expected)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	tests := []struct {
+		name     string
+		quiet    QuietHours
+		now      time.Time
+		contains bool
+		end      time.Time
+	}{
+		{"none", QuietHours{}, at(3, 0), false, time.Time{}},
+		{"day before", QuietHours{8, 17}, at(7, 59), false, time.Time{}},
+		{"day start", QuietHours{8, 17}, at(8, 0), true, at(17, 0)},
+		{"day last hour", QuietHours{8, 17}, at(16, 59), true, at(17, 0)},
+		{"day end", QuietHours{8, 17}, at(17, 0), false, time.Time{}},
+		{"night before", QuietHours{23, 6}, at(22, 59), false, time.Time{}},
+		{"night before midnight", QuietHours{23, 6}, at(23, 30), true, at(6, 0).AddDate(0, 0, 1)},
+		{"night after midnight", QuietHours{23, 6}, at(2, 0), true, at(6, 0)},
+		{"night last hour", QuietHours{23, 6}, at(5, 59), true, at(6, 0)},
+		{"night end", QuietHours{23, 6}, at(6, 0), false, time.Time{}},
+		{"midnight start", QuietHours{0, 6}, at(0, 0), true, at(6, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.quiet.Contains(tt.now); got != tt.contains {
+				t.Fatalf("Contains = %v, expected %v", got, tt.contains)
+			}
+			if !tt.contains {
+				return
+			}
+			if got := tt.quiet.end(tt.now); !got.Equal(tt.end) {
+				t.Errorf("end = %v, expected %v", got, tt.end)
+			}
+		})
+	}
+}
+
+func TestJobWait(t *testing.T) {
+	upstream := WrapError(ErrUpstreamUnavailable, errors.New("503"))
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		quiet    QuietHours
+		now      time.Time
+		expected time.Duration
+	}{
+		{"success", 0, nil, QuietHours{}, at(12, 0), time.Hour},
+		{"first failure", 1, upstream, QuietHours{}, at(12, 0), time.Minute},
+		{"second failure doubles", 2, upstream, QuietHours{}, at(12, 0), 2 * time.Minute},
+		{"fourth failure doubles", 4, upstream, QuietHours{}, at(12, 0), 8 * time.Minute},
+		{"capped", 10, upstream, QuietHours{}, at(12, 0), 20 * time.Minute},
+		{"unknown error backs off", 3, errors.New("eof"), QuietHours{}, at(12, 0), 4 * time.Minute},
+		{"auth", 1, WrapError(ErrAuthFailed, errors.New("401")), QuietHours{}, at(12, 0), 6 * time.Hour},
+		{"layout", 1, WrapError(ErrLayoutChanged, errors.New("no table")), QuietHours{}, at(12, 0), 20 * time.Minute},
+		{"outside quiet hours", 0, nil, QuietHours{23, 6}, at(21, 0), time.Hour},
+		{"into quiet hours", 0, nil, QuietHours{23, 6}, at(22, 30), 7*time.Hour + 30*time.Minute},
+		{"backoff into quiet hours", 1, upstream, QuietHours{23, 6}, at(22, 59), 7*time.Hour + time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Job{}
+			j.Interval = time.Hour
+			j.MinBackoff = time.Minute
+			j.MaxBackoff = 20 * time.Minute
+			j.AuthBackoff = 6 * time.Hour
+			j.Quiet = &tt.quiet
+			j.failures = tt.failures
+			j.err = tt.err
+			if got := j.wait(tt.now); got != tt.expected {
+				t.Errorf("wait = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	now := at(12, 0)
+	tests := []struct {
+		name      string
+		trigger   string
+		running   time.Time
+		finished  time.Time
+		err       error
+		pending   bool
+		triggered bool
+	}{
+		{"idle", "", time.Time{}, now.Add(-time.Hour), nil, false, true},
+		{"by name", "job", time.Time{}, now.Add(-time.Hour), nil, false, true},
+		{"other job", "other", time.Time{}, now.Add(-time.Hour), nil, false, false},
+		{"never run", "", time.Time{}, time.Time{}, nil, false, true},
+		{"running", "", now.Add(-time.Second), now.Add(-time.Hour), nil, false, false},
+		{"just ran", "", time.Time{}, now.Add(-30 * time.Second), nil, false, false},
+		{"debounce over", "", time.Time{}, now.Add(-time.Minute), nil, false, true},
+		{"auth failed", "", time.Time{}, now.Add(-time.Hour), WrapError(ErrAuthFailed, errors.New("401")), false, false},
+		{"upstream failed", "", time.Time{}, now.Add(-time.Hour), WrapError(ErrUpstreamUnavailable, errors.New("503")), false, true},
+		{"already pending", "", time.Time{}, now.Add(-time.Hour), nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler()
+			j := &Job{}
+			j.Name = "job"
+			s.Add(j)
+			j.running = tt.running
+			j.finished = tt.finished
+			j.err = tt.err
+			if tt.pending {
+				j.trigger <- struct{}{}
+			}
+			s.triggerAt(tt.trigger, now)
+			if triggered := len(j.trigger) == 1; triggered != tt.triggered {
+				t.Errorf("triggered = %v, expected %v", triggered, tt.triggered)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// SentLog remembers which notifications have been sent by key, so they
+// are sent once. It's saved to File on every change if File is set.
+type SentLog struct {
+	File string
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// OpenSentLog returns a SentLog with the keys in file, a missing file
+// gives an empty log. An empty file name keeps the log in memory only.
+func OpenSentLog(file string) (*SentLog, error) {
+	l := &SentLog{}
+	l.File = file
+	l.sent = make(map[string]time.Time)
+	if file == "" {
+		return l, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(data, &l.sent)
+
+	return l, err
+}
+
+// Sent returns true if key has been sent
+func (l *SentLog) Sent(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.sent[key]
+
+	return ok
+}
+
+// Add marks key as sent at t
+func (l *SentLog) Add(key string, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sent[key] = t
+
+	return l.save()
+}
+
+// Prune forgets keys sent before t
+func (l *SentLog) Prune(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pruned := false
+	for key, sent := range l.sent {
+		if sent.Before(t) {
+			delete(l.sent, key)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+
+	return l.save()
+}
+
+func (l *SentLog) save() error {
+	if l.File == "" {
+		return nil
+	}
+	out, err := json.Marshal(l.sent)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(l.File, out, 0644)
+}
+
+// Remove forgets key, eg when the condition notified about has cleared.
+// Returns true if key had been sent.
+func (l *SentLog) Remove(key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.sent[key]; !ok {
+		return false, nil
+	}
+	delete(l.sent, key)
+
+	return true, l.save()
+}
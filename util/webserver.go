@@ -1,27 +1,34 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Webserver creates a webserver that gracefully shuts down on ctrl-C
-func Webserver(name string, address string, handler http.Handler) {
+// Webserver runs a webserver until ctx is cancelled and then shuts it down
+// gracefully, letting active requests finish
+func Webserver(ctx context.Context, name string, address string, handler http.Handler) {
 	srv := &http.Server{Addr: address, Handler: handler}
+	stopped := make(chan struct{})
 	go func() {
-		done := make(chan os.Signal)
-		signal.Notify(done, os.Interrupt)
-		<-done
+		defer close(stopped)
+		<-ctx.Done()
 		log.Info("Shutting down ", name)
-		srv.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.WithField("error", err).Error("Error shutting down ", name)
+		}
 	}()
 	err := srv.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		fmt.Println(err)
 		panic("Can't start " + name)
 	}
+	<-stopped
 }